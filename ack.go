@@ -0,0 +1,98 @@
+package automergendjsonsync
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/automerge/automerge-go"
+)
+
+// MarkPersisted tells the doc that its storage has durably written the doc at the given heads, such as after saving
+// it to disk. Every ServeChanges session of the doc then sends EventAck with the heads, so that clients can wait for
+// their changes to be persisted with WaitForPersistedHeads.
+func (b *SharedDoc) MarkPersisted(heads []automerge.ChangeHash) {
+	b.mutex.Lock()
+	b.persistedHeads = slices.Clone(heads)
+	b.mutex.Unlock()
+	// The hint wakes up the writers so that they send the ack.
+	b.NotifyReceivedChanges()
+}
+
+// pendingAcks returns a function for the writer of a session that returns EventAck whenever the persisted heads have
+// changed since it was last called.
+func (b *SharedDoc) pendingAcks() func() []*NdJson {
+	var acked []automerge.ChangeHash
+	return func() []*NdJson {
+		b.mutex.Lock()
+		heads := b.persistedHeads
+		b.mutex.Unlock()
+		if heads == nil || slices.Equal(heads, acked) {
+			return nil
+		}
+		acked = heads
+		return []*NdJson{{Event: EventAck, Data: encodeAckHeads(heads)}}
+	}
+}
+
+func encodeAckHeads(heads []automerge.ChangeHash) []byte {
+	data := make([]byte, 0, len(heads)*32)
+	for _, h := range heads {
+		data = append(data, h[:]...)
+	}
+	return data
+}
+
+func decodeAckHeads(data []byte) ([]automerge.ChangeHash, error) {
+	if len(data)%32 != 0 {
+		return nil, fmt.Errorf("ack data is not a list of change hashes")
+	}
+	heads := make([]automerge.ChangeHash, len(data)/32)
+	for i := range heads {
+		copy(heads[i][:], data[i*32:])
+	}
+	return heads, nil
+}
+
+// WaitForPersistedHeads blocks until the server of an active session that uses the given sync state has acknowledged
+// that it persisted all the given heads, or changes that build on them, with EventAck. Changes that build on the heads
+// are only recognised once they have been received locally. Like WaitForRemoteHeads, only active sessions count.
+func (b *SharedDoc) WaitForPersistedHeads(ctx context.Context, state *automerge.SyncState, heads []automerge.ChangeHash) error {
+	return b.waitForRemoteHeads(ctx, heads, func(s *liveSession) []automerge.ChangeHash {
+		return s.persistedHeads
+	}, func(sessions map[string]*liveSession) ([]*liveSession, error) {
+		return sessionsWithState(sessions, state), nil
+	})
+}
+
+type ackReader struct {
+	reader  messageReader
+	doc     *SharedDoc
+	session *liveSession
+}
+
+func (r *ackReader) ReadMessage() (*NdJson, int, error) {
+	e, n, err := r.reader.ReadMessage()
+	if err != nil || e.Event != EventAck {
+		return e, n, err
+	}
+	heads, err := decodeAckHeads(e.Data)
+	if err != nil {
+		return nil, 0, &malformedMessageError{err: err}
+	}
+	r.session.mutex.Lock()
+	r.session.persistedHeads = heads
+	r.session.mutex.Unlock()
+	r.doc.mutex.Lock()
+	r.doc.notifyRemoteHeadsChanged()
+	r.doc.mutex.Unlock()
+	return e, n, nil
+}
+
+// ackTrackReader wraps the reader so that the heads of each EventAck are recorded on the session, if there is one.
+func (b *SharedDoc) ackTrackReader(session *liveSession, reader messageReader) messageReader {
+	if session == nil {
+		return reader
+	}
+	return &ackReader{reader: reader, doc: b, session: session}
+}
@@ -0,0 +1,75 @@
+package automergendjsonsync
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/automerge/automerge-go"
+)
+
+func TestWaitForPersistedHeads(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	serverDoc := NewSharedDoc(automerge.New())
+	url := startTestServer(t, &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = serverDoc.ServeChanges(w, r)
+	})})
+
+	clientDoc := NewSharedDoc(automerge.New())
+	state := automerge.NewSyncState(clientDoc.Doc())
+	clientErrs := make(chan error, 1)
+	go func() {
+		clientErrs <- clientDoc.HttpPushPullChanges(ctx, url, WithClientSyncState(state))
+	}()
+	session := waitForSession(t, clientDoc)
+
+	assertEqual(t, clientDoc.Doc().RootMap().Set("a", "b"), nil)
+	_, _ = clientDoc.Doc().Commit("change")
+	clientDoc.NotifyReceivedChanges()
+	heads := clientDoc.Doc().Heads()
+	assertEqual(t, clientDoc.WaitForRemoteHeads(ctx, state, heads), nil)
+
+	t.Run("not persisted", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(ctx, time.Millisecond*50)
+		defer cancel()
+		assertEqual(t, errors.Is(clientDoc.WaitForPersistedHeads(ctx, state, heads), context.DeadlineExceeded), true)
+	})
+
+	t.Run("persisted", func(t *testing.T) {
+		serverDoc.MarkPersisted(serverDoc.Doc().Heads())
+		assertEqual(t, clientDoc.WaitForPersistedHeads(ctx, state, heads), nil)
+	})
+
+	t.Run("persisted with later changes", func(t *testing.T) {
+		assertEqual(t, clientDoc.Doc().RootMap().Set("c", "d"), nil)
+		_, _ = clientDoc.Doc().Commit("change")
+		clientDoc.NotifyReceivedChanges()
+		heads := clientDoc.Doc().Heads()
+		assertEqual(t, clientDoc.WaitForRemoteHeads(ctx, state, heads), nil)
+
+		// the server persists a change of its own on top, which the client needs to know about to match the ack
+		assertEqual(t, serverDoc.Doc().RootMap().Set("e", "f"), nil)
+		_, _ = serverDoc.Doc().Commit("change")
+		serverDoc.MarkPersisted(serverDoc.Doc().Heads())
+		assertEqual(t, clientDoc.WaitForPersistedHeads(ctx, state, heads), nil)
+	})
+
+	assertEqual(t, clientDoc.DisconnectSession(session.Id), true)
+	assertEqual(t, errors.Is(<-clientErrs, ErrSessionDisconnected), true)
+}
+
+func TestDecodeAckHeads(t *testing.T) {
+	t.Parallel()
+	var a, b automerge.ChangeHash
+	a[0], b[31] = 1, 2
+	heads, err := decodeAckHeads(encodeAckHeads([]automerge.ChangeHash{a, b}))
+	assertEqual(t, err, nil)
+	assertEqual(t, heads, []automerge.ChangeHash{a, b})
+	_, err = decodeAckHeads(make([]byte, 33))
+	assertErrorEqual(t, err, "ack data is not a list of change hashes")
+}
@@ -7,60 +7,135 @@ import (
 	"io"
 	"log/slog"
 	"net/http"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/automerge/automerge-go"
 )
 
-// The messageGenerator is a io.ReadCloser which runs generateMessagesToWriter in a goroutine once the first read is
-// requested. This uses an IO pipe so messages are only generated at the rate that they are being read off the reader.
-// Some extra context and synchronisation elements are stored in the struct in order to optimise things.
-type messageGenerator struct {
-	ctx    context.Context
-	state  *automerge.SyncState
-	hints  <-chan bool
-	writer *io.PipeWriter
-	reader *io.PipeReader
-	wg     *sync.WaitGroup
-	once   sync.Once
+// requestSession runs the sync for HttpPushPullChanges with an io.Pipe as the request body. The sync is only started
+// when the http client first reads from the body, or once the response has arrived if the body is never read. This
+// ensures that no messages are generated, and so no changes are marked as sent in the sync state, for a request that
+// is rejected or redirected before its body is sent.
+type requestSession struct {
+	run     func(w *io.PipeWriter) error
+	mutex   sync.Mutex
+	writer  *io.PipeWriter
+	started bool
+	done    chan struct{}
+	err     error
 }
 
-func newMessageGenerator(ctx context.Context, state *automerge.SyncState, hints <-chan bool, wg *sync.WaitGroup) *messageGenerator {
-	return &messageGenerator{ctx: ctx, state: state, hints: hints, wg: wg}
+func newRequestSession(run func(w *io.PipeWriter) error) *requestSession {
+	return &requestSession{run: run, done: make(chan struct{})}
 }
 
-func (mg *messageGenerator) background() {
-	defer mg.wg.Done()
-	if err := generateMessagesToWriter(mg.ctx, mg.state, mg.hints, mg.writer, false); err != nil && !errors.Is(err, context.Canceled) {
-		_ = mg.writer.CloseWithError(err)
-	} else {
-		_ = mg.writer.Close()
+// newBody returns a new request body. This is used as the GetBody function of the request so that the http client can
+// replay the body for a redirect, which is only possible if the sync has not started yet.
+func (s *requestSession) newBody() (io.ReadCloser, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.started {
+		return nil, fmt.Errorf("the request body cannot be replayed once the sync has started")
 	}
+	reader, writer := io.Pipe()
+	s.writer = writer
+	return &requestBody{session: s, reader: reader, writer: writer}, nil
 }
 
-func (mg *messageGenerator) start() {
-	mg.wg.Add(1)
-	mg.reader, mg.writer = io.Pipe()
-	go mg.background()
+// start starts the sync in the background with the writer of the given body, or of the latest body if nil. Only the
+// first call for the latest body has any effect.
+func (s *requestSession) start(writer *io.PipeWriter) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.started || (writer != nil && writer != s.writer) {
+		return
+	}
+	s.started = true
+	go func() {
+		defer close(s.done)
+		s.err = s.run(s.writer)
+	}()
 }
 
-func (mg *messageGenerator) Close() error {
-	mg.once.Do(func() {})
-	if mg.reader == nil {
+// wait returns the result of the sync once it has finished, or nil if it was never started.
+func (s *requestSession) wait() error {
+	s.mutex.Lock()
+	started := s.started
+	s.mutex.Unlock()
+	if !started {
 		return nil
 	}
-	return mg.reader.Close()
+	<-s.done
+	return s.err
+}
+
+type requestBody struct {
+	session *requestSession
+	reader  *io.PipeReader
+	writer  *io.PipeWriter
 }
 
-func (mg *messageGenerator) Read(p []byte) (int, error) {
-	mg.once.Do(mg.start)
-	if mg.reader == nil {
-		return 0, io.ErrClosedPipe
+func (rb *requestBody) Read(p []byte) (int, error) {
+	rb.session.start(rb.writer)
+	return rb.reader.Read(p)
+}
+
+func (rb *requestBody) Close() error {
+	return rb.reader.Close()
+}
+
+var _ io.ReadCloser = (*requestBody)(nil)
+
+// responseReader is a messageReader for the response body which blocks until the response has arrived, since the
+// sync may be started by the request body before then.
+type responseReader struct {
+	ready  chan struct{}
+	once   sync.Once
+	reader messageReader
+	err    error
+}
+
+// resolve sets the reader or the error to return. Only the first call has any effect.
+func (r *responseReader) resolve(reader messageReader, err error) {
+	r.once.Do(func() {
+		r.reader, r.err = reader, err
+		close(r.ready)
+	})
+}
+
+func (r *responseReader) ReadMessage() (*NdJson, int, error) {
+	<-r.ready
+	if r.err != nil {
+		return nil, 0, r.err
 	}
-	return mg.reader.Read(p)
+	return r.reader.ReadMessage()
 }
 
-var _ io.ReadCloser = (*messageGenerator)(nil)
+// HttpStatusError is returned by HttpPushPullChanges when the server responds with a status other than 200 OK.
+type HttpStatusError struct {
+	StatusCode int
+	// RetryAfter is the delay requested by the Retry-After header of the response, or 0 if there wasn't one. Servers
+	// send this with a 503 Service Unavailable when they are over a session limit or draining.
+	RetryAfter time.Duration
+}
+
+func (e *HttpStatusError) Error() string {
+	return fmt.Sprintf("http request failed with status %d", e.StatusCode)
+}
+
+// parseRetryAfter returns the delay from a Retry-After header, which is either a number of seconds or an http date.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	} else if seconds, err := strconv.Atoi(v); err == nil {
+		return max(0, time.Duration(seconds)*time.Second)
+	} else if t, err := http.ParseTime(v); err == nil {
+		return max(0, t.Sub(now))
+	}
+	return 0
+}
 
 type HttpDoer interface {
 	Do(req *http.Request) (*http.Response, error)
@@ -75,14 +150,25 @@ func (f HttpDoerFunc) Do(req *http.Request) (*http.Response, error) {
 type clientOptions struct {
 	client           HttpDoer
 	state            *automerge.SyncState
+	readPredicate    ReadPredicate
 	terminationCheck TerminationCheck
 	reqEditors       []func(r *http.Request)
+	contentType      string
+	statusCallback   func(status PeerStatus)
+	recorder         Recorder
+	keyring          *Keyring
+	signer           *Signer
+	linePredicates   []LineReadPredicate
+	timeouts         sessionTimeouts
+	mode             clientMode
+	progress         func(progress SyncProgress)
+	hooks            *SessionHooks
 }
 
 type ClientOption func(*clientOptions)
 
 func newClientOptions(opts ...ClientOption) *clientOptions {
-	options := &clientOptions{client: http.DefaultClient, terminationCheck: NoTerminationCheck}
+	options := &clientOptions{client: http.DefaultClient, readPredicate: NoReadPredicate, terminationCheck: NoTerminationCheck, contentType: ContentType}
 	for _, opt := range opts {
 		opt(options)
 	}
@@ -95,12 +181,22 @@ func WithHttpClient(client HttpDoer) ClientOption {
 	}
 }
 
+// WithClientSyncState sets the sync state to use with the server. This is not allowed with SyncWithPeers since each
+// server there requires its own sync state.
 func WithClientSyncState(state *automerge.SyncState) ClientOption {
 	return func(o *clientOptions) {
 		o.state = state
 	}
 }
 
+// WithClientReadPredicate sets a ReadPredicate which must include each message from the server for the message to be
+// received, such as TrustedActorsReadPredicate.
+func WithClientReadPredicate(f ReadPredicate) ClientOption {
+	return func(o *clientOptions) {
+		o.readPredicate = f
+	}
+}
+
 func WithClientTerminationCheck(check TerminationCheck) ClientOption {
 	return func(o *clientOptions) {
 		o.terminationCheck = check
@@ -113,22 +209,102 @@ func WithClientRequestEditor(f func(r *http.Request)) ClientOption {
 	}
 }
 
+// WithClientContentType sets the wire format used for the request body and requested for the response body. This
+// should be either ContentType (the default) or ContentTypeBinary.
+func WithClientContentType(contentType string) ClientOption {
+	return func(o *clientOptions) {
+		o.contentType = contentType
+	}
+}
+
+// WithPeerStatusCallback sets a function that is called with the status of the connection as it progresses: when the
+// server accepts the connection, after each received message, and when the connection finishes or fails. When used
+// with SyncWithPeers, the function is called concurrently for each server.
+func WithPeerStatusCallback(f func(status PeerStatus)) ClientOption {
+	return func(o *clientOptions) {
+		o.statusCallback = f
+	}
+}
+
+// WithClientRecorder passes every message written to the request and read from the response to the recorder.
+func WithClientRecorder(recorder Recorder) ClientOption {
+	return func(o *clientOptions) {
+		o.recorder = recorder
+	}
+}
+
+// WithClientEncryption encrypts and decrypts the data of every message with the keys in the keyring, so that the
+// server, or a BlindRelay between peers, can't read the document content.
+func WithClientEncryption(keyring *Keyring) ClientOption {
+	return func(o *clientOptions) {
+		o.keyring = keyring
+	}
+}
+
+// WithClientSigner signs the data of every message written to the request.
+func WithClientSigner(signer *Signer) ClientOption {
+	return func(o *clientOptions) {
+		o.signer = signer
+	}
+}
+
+// WithClientLineReadPredicate adds a LineReadPredicate which must include each message from the server for the message
+// to be received. This can be used more than once.
+func WithClientLineReadPredicate(f LineReadPredicate) ClientOption {
+	return func(o *clientOptions) {
+		o.linePredicates = append(o.linePredicates, f)
+	}
+}
+
 // HttpPushPullChanges is the HTTP client function to synchronise a local document with a remote server. This uses either HTTP2 or HTTP1.1 depending on the
 // remote server - HTTP2 is preferred since it has better understood bidirectional body capabilities.
-func (b *SharedDoc) HttpPushPullChanges(ctx context.Context, url string, opts ...ClientOption) error {
+func (b *SharedDoc) HttpPushPullChanges(ctx context.Context, url string, opts ...ClientOption) (finalErr error) {
 	log := Logger(ctx)
 	o := newClientOptions(opts...)
 	if o.state == nil {
 		o.state = automerge.NewSyncState(b.Doc())
 	}
+	status := PeerStatus{Url: url, State: o.state, Phase: PeerConnecting}
+	report := func(phase PeerPhase) {
+		if o.statusCallback != nil {
+			status.Phase = phase
+			o.statusCallback(status)
+		}
+	}
+	defer func() {
+		if status.Err = finalErr; finalErr != nil {
+			report(PeerFailed)
+		} else {
+			report(PeerFinished)
+		}
+	}()
+	contentType, ok := suitableContentType(o.contentType)
+	if !ok {
+		return fmt.Errorf("unsupported content type %s", o.contentType)
+	}
+	ctx, live, finish, err := b.startSession(ctx, SessionInfo{Role: SessionClient, RemoteAddr: url}, o.state, 0)
+	if err != nil {
+		return err
+	}
+	defer finish()
+	hooks := newHookRunner(o.hooks, live, b.doc)
+	defer func() {
+		hooks.disconnect(context.WithoutCancel(ctx), finalErr)
+	}()
+	defer func() {
+		if cause := context.Cause(ctx); finalErr != nil && errors.Is(cause, ErrSessionDisconnected) {
+			finalErr = cause
+		}
+	}()
+	go live.watch(ctx, o.timeouts)
 
 	// We use the PUT method here because we are modifying a document in place.
 	r, err := http.NewRequestWithContext(ctx, http.MethodPut, url, nil)
 	if err != nil {
 		return fmt.Errorf("failed to setup request: %w", err)
 	}
-	r.Header.Set("Content-Type", ContentTypeWithCharset)
-	r.Header.Set("Accept", ContentType)
+	r.Header.Set("Content-Type", contentTypeHeader(contentType))
+	r.Header.Set("Accept", contentType)
 	r.Header.Set("Cache-Control", "no-store")
 	// We don't need to send the body content if the server will reject it, so we can notify that expect-continue is supported.
 	r.Header.Set("Expect", "100-continue")
@@ -136,41 +312,82 @@ func (b *SharedDoc) HttpPushPullChanges(ctx context.Context, url string, opts ..
 		editor(r)
 	}
 
-	wg := new(sync.WaitGroup)
-	defer wg.Wait()
-
-	sub, fin := b.SubscribeToReceivedChanges()
-	defer fin()
-
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
+	innerTerminationCheck := o.terminationCheck
+	switch o.mode {
+	case clientPullOnly:
+		innerTerminationCheck = HasAllRemoteHeads
+	case clientPushOnly:
+		innerTerminationCheck = remoteHasSyncedLocalHeads
+	}
 
-	// We use a special body generator that runs in a goroutine on demand in order to generate new messages.
-	r.Body = newMessageGenerator(ctx, o.state, sub, wg)
-	r.GetBody = func() (io.ReadCloser, error) {
-		return newMessageGenerator(ctx, o.state, sub, wg), nil
+	// Wrapping the termination check allows us to observe every received message without affecting the reader.
+	terminationCheck := func(doc *automerge.Doc, m *automerge.SyncMessage) bool {
+		status.ReceivedMessages++
+		status.RemoteHeads = m.Heads()
+		report(PeerReceived)
+		return innerTerminationCheck(doc, m)
 	}
 
+	responses := &responseReader{ready: make(chan struct{})}
+	session := newRequestSession(func(w *io.PipeWriter) error {
+		// The sync starts once the request body is being sent, which may be before the response has arrived.
+		hooks.connect(ctx, r)
+		return b.syncMessages(ctx, responses, newMessageWriter(contentType, w), &streamOptions{
+			state:               o.state,
+			readPredicate:       o.readPredicate,
+			terminationCheck:    terminationCheck,
+			recorder:            o.recorder,
+			keyring:             o.keyring,
+			signer:              o.signer,
+			linePredicates:      o.linePredicates,
+			session:             live,
+			stripWrittenChanges: o.mode == clientPullOnly,
+			stripReadChanges:    o.mode == clientPushOnly,
+			progress:            o.progress,
+			hooks:               hooks,
+		})
+	})
+	// Whatever happens, the sync must have stopped before we return.
+	defer func() {
+		responses.resolve(nil, fmt.Errorf("no response"))
+		_ = session.wait()
+	}()
+	r.Body, _ = session.newBody()
+	r.GetBody = session.newBody
+
 	res, err := o.client.Do(r)
 	if err != nil {
 		return fmt.Errorf("http request failed: %w", err)
 	}
 	log.InfoContext(ctx, "received http sync response", slog.String("proto", res.Proto), slog.String("target", fmt.Sprintf("%s %s", http.MethodPut, url)), slog.Int("status", res.StatusCode))
 	if res.StatusCode != 200 {
-		return fmt.Errorf("http request failed with status %d", res.StatusCode)
+		if res.Body != nil {
+			_ = res.Body.Close()
+		}
+		return &HttpStatusError{StatusCode: res.StatusCode, RetryAfter: parseRetryAfter(res.Header.Get("Retry-After"), time.Now())}
 	}
 	defer func() {
 		if err := res.Body.Close(); err != nil {
 			log.ErrorContext(ctx, "failed to close response body", slog.Any("err", err))
 		}
 	}()
+	report(PeerConnected)
+	live.update(func(info *SessionInfo) {
+		info.Protocol = res.Proto
+		if res.TLS != nil && len(res.TLS.PeerCertificates) > 0 {
+			info.PeerId = res.TLS.PeerCertificates[0].Subject.CommonName
+		}
+	})
 
-	if v := res.Header.Get("Content-Type"); v != "" && isNotSuitableContentType(v) {
-		return fmt.Errorf("http request returned a response with an unsuitable content type %s", v)
+	// The server may respond in a different format to the one we requested, so the response content type wins.
+	responseContentType := contentType
+	if v := res.Header.Get("Content-Type"); v != "" {
+		if responseContentType, ok = suitableContentType(v); !ok {
+			return fmt.Errorf("http request returned a response with an unsuitable content type %s", v)
+		}
 	}
 
-	if _, err := b.consumeMessagesFromReader(ctx, o.state, res.Body, NoReadPredicate, o.terminationCheck); err != nil {
-		return err
-	}
-	return nil
+	responses.resolve(newMessageReader(responseContentType, res.Body), nil)
+	session.start(nil)
+	return session.wait()
 }
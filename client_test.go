@@ -10,61 +10,65 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
 	"strconv"
 	"strings"
-	"sync"
 	"testing"
+	"time"
 
 	"github.com/automerge/automerge-go"
 )
 
-func TestMessageGenerator(t *testing.T) {
+func TestRequestSession(t *testing.T) {
 	t.Parallel()
 
-	t.Run("can be cancelled immediately", func(t *testing.T) {
+	t.Run("body can be replayed until started", func(t *testing.T) {
 		t.Parallel()
-		doc := automerge.New()
-		state := automerge.NewSyncState(doc)
+		var started *io.PipeWriter
+		session := newRequestSession(func(w *io.PipeWriter) error {
+			started = w
+			return w.Close()
+		})
+		body1, err := session.newBody()
+		assertEqual(t, err, nil)
+		body2, err := session.newBody()
+		assertEqual(t, err, nil)
 
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
+		// the first body is stale so does not start the session
+		session.start(body1.(*requestBody).writer)
+		assertEqual(t, session.wait(), nil)
 
-		hints := make(chan bool)
-		wg := new(sync.WaitGroup)
-		wg.Add(1)
-		mg := newMessageGenerator(ctx, state, hints, wg)
-		cancel()
-		buff := new(bytes.Buffer)
-		_, err := io.Copy(buff, mg)
+		raw, err := io.ReadAll(body2)
 		assertEqual(t, err, nil)
-		assertEqual(t, len(strings.Split(strings.TrimSpace(buff.String()), "\n")), 1)
+		assertEqual(t, len(raw), 0)
+		assertEqual(t, session.wait(), nil)
+		assertEqual(t, started, body2.(*requestBody).writer)
+
+		_, err = session.newBody()
+		assertErrorEqual(t, err, "the request body cannot be replayed once the sync has started")
 	})
 
 	t.Run("can be closed by the reader", func(t *testing.T) {
 		t.Parallel()
-		doc := automerge.New()
-		state := automerge.NewSyncState(doc)
-
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
-
-		hints := make(chan bool)
-		wg := new(sync.WaitGroup)
-		wg.Add(1)
-		mg := newMessageGenerator(ctx, state, hints, wg)
-		assertEqual(t, mg.Close(), nil)
+		session := newRequestSession(func(w *io.PipeWriter) error {
+			_, err := w.Write([]byte("hello"))
+			return err
+		})
+		body, _ := session.newBody()
+		assertEqual(t, body.Close(), nil)
 		buff := new(bytes.Buffer)
-		_, err := io.Copy(buff, mg)
+		_, err := io.Copy(buff, body)
 		assertEqual(t, err, io.ErrClosedPipe)
 		assertEqual(t, buff.Len(), 0)
+		assertEqual(t, session.wait(), io.ErrClosedPipe)
 	})
 
 	for _, hasPeer := range []bool{true, false} {
 		t.Run(fmt.Sprintf("nominal hasPeer=%v", hasPeer), func(t *testing.T) {
 			t.Parallel()
 
-			doc := automerge.New()
-			state := automerge.NewSyncState(doc)
+			sd := NewSharedDoc(automerge.New())
+			state := automerge.NewSyncState(sd.Doc())
 
 			doc2 := automerge.New()
 			state2 := automerge.NewSyncState(doc2)
@@ -76,23 +80,35 @@ func TestMessageGenerator(t *testing.T) {
 			ctx, cancel := context.WithCancel(context.Background())
 			defer cancel()
 
-			hints := make(chan bool)
-			wg := new(sync.WaitGroup)
-			wg.Add(1)
-			mg := newMessageGenerator(ctx, state, hints, wg)
+			// the response never arrives, so the session writes messages until it is cancelled
+			responses := &responseReader{ready: make(chan struct{})}
+			session := newRequestSession(func(w *io.PipeWriter) error {
+				return sd.syncMessages(ctx, responses, newMessageWriter(ContentType, w), &streamOptions{
+					state: state, readPredicate: NoReadPredicate, terminationCheck: NoTerminationCheck,
+				})
+			})
+			body, _ := session.newBody()
 
+			// make changes, and cancel once the final heads have been seen by the reader
+			seen := make(chan []automerge.ChangeHash)
 			go func() {
 				for i := 0; i < 10; i++ {
-					_ = doc.RootMap().Set(strconv.Itoa(i), "hello")
-					_, _ = doc.Commit("committed")
-					hints <- true
+					_ = sd.Doc().RootMap().Set(strconv.Itoa(i), "hello")
+					_, _ = sd.Doc().Commit("committed")
+					sd.NotifyReceivedChanges()
+				}
+				finalHeads := sd.Doc().Heads()
+				for heads := range seen {
+					if slices.Equal(heads, finalHeads) {
+						cancel()
+						responses.resolve(nil, context.Canceled)
+					}
 				}
-				cancel()
 			}()
 
 			changeCount := 0
 			var lastHeads []automerge.ChangeHash
-			sc := bufio.NewScanner(mg)
+			sc := bufio.NewScanner(body)
 			for sc.Scan() {
 				e := NdJson{}
 				assertEqual(t, json.Unmarshal(sc.Bytes(), &e), nil)
@@ -100,8 +116,11 @@ func TestMessageGenerator(t *testing.T) {
 				assertEqual(t, err, nil)
 				changeCount += len(m.Changes())
 				lastHeads = m.Heads()
+				seen <- lastHeads
 			}
-			assertEqual(t, lastHeads, doc.Heads())
+			close(seen)
+			assertEqual(t, session.wait(), context.Canceled)
+			assertEqual(t, lastHeads, sd.Doc().Heads())
 			if hasPeer {
 				assertEqual(t, changeCount, 10)
 			} else {
@@ -109,7 +128,6 @@ func TestMessageGenerator(t *testing.T) {
 			}
 		})
 	}
-
 }
 
 func TestHttpPushPullChanges(t *testing.T) {
@@ -167,13 +185,14 @@ func TestHttpPushPullChanges(t *testing.T) {
 			// we should get at least the first message line in the request body
 			assertEqual(t, sc.Scan(), true)
 
-			doc2 := automerge.New()
-			wg := new(sync.WaitGroup)
-			wg.Add(1)
-			mg2 := newMessageGenerator(context.Background(), automerge.NewSyncState(doc2), make(<-chan bool), wg)
+			// the peer writes its first message and then closes the response body
+			body, writer := io.Pipe()
+			go func() {
+				_ = NewSharedDoc(automerge.New()).SyncOverStream(context.Background(), strings.NewReader(""), writer)
+			}()
 			return &http.Response{
 				StatusCode: http.StatusOK,
-				Body:       mg2,
+				Body:       body,
 			}, nil
 		})), WithClientTerminationCheck(func(doc *automerge.Doc, m *automerge.SyncMessage) bool {
 			checkCalled = true
@@ -182,3 +201,26 @@ func TestHttpPushPullChanges(t *testing.T) {
 		assertEqual(t, checkCalled, true)
 	})
 }
+
+func TestHttpPushPullChanges_read_predicate(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	serverDoc := NewSharedDoc(automerge.New())
+	assertEqual(t, serverDoc.Doc().RootMap().Set("a", "b"), nil)
+	_, _ = serverDoc.Doc().Commit("change")
+	url := startTestServer(t, &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = serverDoc.ServeChanges(w, r)
+	})})
+
+	clientDoc := NewSharedDoc(automerge.New())
+	err := clientDoc.HttpPushPullChanges(ctx, url, WithClientReadPredicate(TrustedActorsReadPredicate(clientDoc.Doc().ActorID())))
+	// the changes may arrive in the first or second message depending on when the server receives our first message
+	assertEqual(t, strings.HasSuffix(fmt.Sprint(err), ": change from untrusted actor '"+serverDoc.Doc().ActorID()+"'"), true)
+	assertEqual(t, len(clientDoc.Doc().Heads()), 0)
+
+	err = clientDoc.HttpPushPullChanges(ctx, url, WithClientReadPredicate(TrustedActorsReadPredicate(serverDoc.Doc().ActorID())), WithClientTerminationCheck(HasAllRemoteHeads))
+	assertEqual(t, err, nil)
+	assertEqual(t, clientDoc.Doc().Heads(), serverDoc.Doc().Heads())
+}
@@ -0,0 +1,412 @@
+// Command amsync pushes, pulls, follows and inspects automerge documents on servers that use the
+// automerge-ndjson-sync protocol.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/automerge/automerge-go"
+
+	"github.com/astromechza/automerge-ndjson-sync"
+)
+
+const usage = `usage: amsync <command> [flags] [args]
+
+commands:
+  pull [-o file] <url>       pull a remote doc into a local .automerge file without uploading local changes
+  push [-i file] <url>       push a local .automerge file to a url without downloading remote changes
+  follow <url>               follow a remote doc and print each change as json
+  dump <url|file>            print the heads and root map of a doc as json
+  decode [-json] [file]      decode a captured sync stream from a file or stdin
+
+Run 'amsync <command> -h' for the flags of each command.
+`
+
+func main() {
+	if err := mainInner(os.Args[1:]); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			slog.Error(err.Error())
+		}
+		os.Exit(1)
+	}
+}
+
+func mainInner(args []string) error {
+	if len(args) == 0 {
+		_, _ = fmt.Fprint(os.Stderr, usage)
+		return flag.ErrHelp
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	switch args[0] {
+	case "pull":
+		return pullCommand(ctx, args[1:])
+	case "push":
+		return pushCommand(ctx, args[1:])
+	case "follow":
+		return followCommand(ctx, args[1:])
+	case "dump":
+		return dumpCommand(ctx, args[1:])
+	case "decode":
+		return decodeCommand(args[1:])
+	case "help", "-h", "--help":
+		_, _ = fmt.Fprint(os.Stdout, usage)
+		return nil
+	default:
+		_, _ = fmt.Fprint(os.Stderr, usage)
+		return fmt.Errorf("unknown command '%s'", args[0])
+	}
+}
+
+// headerFlags collects repeated -H flags.
+type headerFlags []string
+
+func (h *headerFlags) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerFlags) Set(v string) error {
+	if name, _, ok := strings.Cut(v, ":"); !ok || strings.TrimSpace(name) == "" {
+		return fmt.Errorf("header must be in the form 'Name: value'")
+	}
+	*h = append(*h, v)
+	return nil
+}
+
+var terminationChecks = map[string]automergendjsonsync.TerminationCheck{
+	"none":                   automergendjsonsync.NoTerminationCheck,
+	"heads-equal":            automergendjsonsync.HeadsEqualCheck,
+	"has-remote-heads":       automergendjsonsync.HasAllRemoteHeads,
+	"remote-has-local-heads": automergendjsonsync.RemoteHasAllLocalHeads,
+}
+
+// clientFlags are the flags shared by all the commands that connect to a server.
+type clientFlags struct {
+	insecure bool
+	headers  headerFlags
+	until    string
+	binary   bool
+	verbose  bool
+	progress bool
+}
+
+// newFlagSet returns the flags of a command that connects to a server. The -until flag is only added if there is a
+// default termination check, since pull and push stop once they have pulled or pushed everything.
+func newFlagSet(name string, defaultUntil string) (*flag.FlagSet, *clientFlags) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	cf := &clientFlags{}
+	fs.BoolVar(&cf.insecure, "insecure", false, "skip verification of the server tls certificate")
+	fs.Var(&cf.headers, "H", "extra request header in the form 'Name: value', can be repeated")
+	if defaultUntil != "" {
+		fs.StringVar(&cf.until, "until", defaultUntil, "when to stop syncing: none, heads-equal, has-remote-heads, or remote-has-local-heads")
+	}
+	fs.BoolVar(&cf.binary, "binary", false, "use the binary framing instead of ndjson")
+	fs.BoolVar(&cf.verbose, "v", false, "enable debug logging")
+	fs.BoolVar(&cf.progress, "progress", false, "print the progress of the sync to stderr")
+	return fs, cf
+}
+
+// setup configures logging and returns the context and client options described by the flags.
+func (cf *clientFlags) setup(ctx context.Context) (context.Context, []automergendjsonsync.ClientOption, error) {
+	level := slog.LevelWarn
+	if cf.verbose {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	hc := &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			ForceAttemptHTTP2:     true,
+			ExpectContinueTimeout: http.DefaultTransport.(*http.Transport).ExpectContinueTimeout,
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: cf.insecure,
+			},
+		},
+	}
+	opts := []automergendjsonsync.ClientOption{automergendjsonsync.WithHttpClient(hc)}
+	if cf.until != "" {
+		check, ok := terminationChecks[cf.until]
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown -until value '%s'", cf.until)
+		}
+		opts = append(opts, automergendjsonsync.WithClientTerminationCheck(check))
+	}
+	if len(cf.headers) > 0 {
+		headers := cf.headers
+		opts = append(opts, automergendjsonsync.WithClientRequestEditor(func(r *http.Request) {
+			for _, h := range headers {
+				name, value, _ := strings.Cut(h, ":")
+				r.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+			}
+		}))
+	}
+	if cf.binary {
+		opts = append(opts, automergendjsonsync.WithClientContentType(automergendjsonsync.ContentTypeBinary))
+	}
+	if cf.progress {
+		opts = append(opts, automergendjsonsync.WithClientProgress(func(p automergendjsonsync.SyncProgress) {
+			_, _ = fmt.Fprintf(os.Stderr, "received %d changes (%d bytes), sent %d changes (%d bytes), %d remote heads and %d changes still missing\n", p.ReceivedChanges, p.ReceivedBytes, p.SentChanges, p.SentBytes, p.MissingRemoteHeads, p.LocalNeed)
+		}))
+	}
+	return automergendjsonsync.SetContextLogger(ctx, slog.Default()), opts, nil
+}
+
+func oneArg(fs *flag.FlagSet, args []string, name string) (string, error) {
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	} else if fs.NArg() != 1 {
+		fs.Usage()
+		return "", fmt.Errorf("expected a single %s argument", name)
+	}
+	return fs.Arg(0), nil
+}
+
+func loadDoc(path string) (*automerge.Doc, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read doc: %w", err)
+	}
+	doc, err := automerge.Load(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load doc from %s: %w", path, err)
+	}
+	return doc, nil
+}
+
+// saveDoc writes the doc through a temporary file so that a failure never leaves a partially written doc behind.
+func saveDoc(path string, doc *automerge.Doc) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(doc.Save()); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to write doc: %w", err)
+	} else if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write doc: %w", err)
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func pullCommand(ctx context.Context, args []string) error {
+	fs, cf := newFlagSet("pull", "")
+	output := fs.String("o", "doc.automerge", "the local file to pull into, changes are merged if it already exists")
+	url, err := oneArg(fs, args, "url")
+	if err != nil {
+		return err
+	}
+	ctx, opts, err := cf.setup(ctx)
+	if err != nil {
+		return err
+	}
+	doc := automerge.New()
+	if _, err := os.Stat(*output); err == nil {
+		if doc, err = loadDoc(*output); err != nil {
+			return err
+		}
+	}
+	// Local changes in an existing file are never uploaded by a pull.
+	opts = append(opts, automergendjsonsync.WithClientPullOnly())
+	if err := automergendjsonsync.NewSharedDoc(doc).HttpPushPullChanges(ctx, url, opts...); err != nil {
+		return err
+	}
+	return saveDoc(*output, doc)
+}
+
+func pushCommand(ctx context.Context, args []string) error {
+	fs, cf := newFlagSet("push", "")
+	input := fs.String("i", "doc.automerge", "the local file to push")
+	url, err := oneArg(fs, args, "url")
+	if err != nil {
+		return err
+	}
+	ctx, opts, err := cf.setup(ctx)
+	if err != nil {
+		return err
+	}
+	doc, err := loadDoc(*input)
+	if err != nil {
+		return err
+	}
+	// The remote changes are of no use since the pushed file is not saved.
+	opts = append(opts, automergendjsonsync.WithClientPushOnly())
+	return automergendjsonsync.NewSharedDoc(doc).HttpPushPullChanges(ctx, url, opts...)
+}
+
+func followCommand(ctx context.Context, args []string) error {
+	fs, cf := newFlagSet("follow", "none")
+	url, err := oneArg(fs, args, "url")
+	if err != nil {
+		return err
+	}
+	ctx, opts, err := cf.setup(ctx)
+	if err != nil {
+		return err
+	}
+	sd := automergendjsonsync.NewSharedDoc(automerge.New())
+	sub, fin := sd.SubscribeToReceivedChanges()
+	defer fin()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- sd.HttpPushPullChanges(ctx, url, opts...)
+	}()
+
+	var lastHeads []automerge.ChangeHash
+	for {
+		select {
+		case <-sub:
+			// Only print when the heads have moved since sync messages without changes also trigger the hint.
+			if heads := sd.Doc().Heads(); !slices.Equal(heads, lastHeads) {
+				if err := writeChanges(os.Stdout, sd.Doc(), lastHeads); err != nil {
+					return err
+				}
+				lastHeads = heads
+			}
+		case err := <-done:
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func dumpCommand(ctx context.Context, args []string) error {
+	fs, cf := newFlagSet("dump", "has-remote-heads")
+	target, err := oneArg(fs, args, "url or file")
+	if err != nil {
+		return err
+	}
+	ctx, opts, err := cf.setup(ctx)
+	if err != nil {
+		return err
+	}
+	var doc *automerge.Doc
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		doc = automerge.New()
+		if err := automergendjsonsync.NewSharedDoc(doc).HttpPushPullChanges(ctx, target, opts...); err != nil {
+			return err
+		}
+	} else if doc, err = loadDoc(target); err != nil {
+		return err
+	}
+	return writeDump(os.Stdout, doc, true)
+}
+
+// changeOutput is the json line printed by follow for each change.
+type changeOutput struct {
+	Hash    string    `json:"hash"`
+	Actor   string    `json:"actor"`
+	Seq     uint64    `json:"seq"`
+	Message string    `json:"message,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// writeChanges writes a json line for each change made to the doc since the given heads.
+func writeChanges(w io.Writer, doc *automerge.Doc, since []automerge.ChangeHash) error {
+	changes, err := doc.Changes(since...)
+	if err != nil {
+		return fmt.Errorf("failed to list changes: %w", err)
+	}
+	enc := json.NewEncoder(w)
+	for _, c := range changes {
+		if err := enc.Encode(changeOutput{Hash: c.Hash().String(), Actor: c.ActorID(), Seq: c.ActorSeq(), Message: c.Message(), Time: c.Timestamp()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type dumpOutput struct {
+	Heads []string `json:"heads"`
+	Root  any      `json:"root"`
+}
+
+func writeDump(w io.Writer, doc *automerge.Doc, indent bool) error {
+	heads := doc.Heads()
+	out := dumpOutput{Heads: make([]string, len(heads)), Root: doc.Root().Interface()}
+	for i, head := range heads {
+		out.Heads[i] = head.String()
+	}
+	enc := json.NewEncoder(w)
+	if indent {
+		enc.SetIndent("", "  ")
+	}
+	return enc.Encode(out)
+}
+
+func decodeCommand(args []string) error {
+	fs := flag.NewFlagSet("decode", flag.ContinueOnError)
+	asJson := fs.Bool("json", false, "print each message as a json line instead of text")
+	binary := fs.Bool("binary", false, "decode the binary framing instead of ndjson")
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if fs.NArg() > 1 {
+		fs.Usage()
+		return fmt.Errorf("expected at most one file argument")
+	}
+	var input io.Reader = os.Stdin
+	if fs.NArg() == 1 && fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return fmt.Errorf("failed to open stream: %w", err)
+		}
+		defer f.Close()
+		input = f
+	}
+	contentType := automergendjsonsync.ContentType
+	if *binary {
+		contentType = automergendjsonsync.ContentTypeBinary
+	}
+	enc := json.NewEncoder(os.Stdout)
+	return automergendjsonsync.DecodeSyncStream(contentType, input, func(m *automergendjsonsync.DecodedSyncMessage) error {
+		if *asJson {
+			return enc.Encode(m)
+		}
+		return writeDecodedText(os.Stdout, m)
+	})
+}
+
+func writeDecodedText(w io.Writer, m *automergendjsonsync.DecodedSyncMessage) error {
+	b := new(strings.Builder)
+	_, _ = fmt.Fprintf(b, "#%d %s (%d bytes)\n", m.Index, m.Event, m.Bytes)
+	if m.Event == automergendjsonsync.EventSync {
+		_, _ = fmt.Fprintf(b, "  heads: %s\n", joinOrNone(m.Heads))
+		_, _ = fmt.Fprintf(b, "  need: %s\n", joinOrNone(m.Need))
+		for _, h := range m.Have {
+			_, _ = fmt.Fprintf(b, "  have: last-sync=%s bloom=%d bytes\n", joinOrNone(h.LastSync), h.BloomBytes)
+		}
+		for _, c := range m.Changes {
+			_, _ = fmt.Fprintf(b, "  change %s actor=%s seq=%d time=%s message=%q\n", c.Hash, c.Actor, c.Seq, c.Timestamp.Format(time.RFC3339), c.Message)
+		}
+	} else if m.Event == automergendjsonsync.EventAck {
+		_, _ = fmt.Fprintf(b, "  persisted heads: %s\n", joinOrNone(m.Heads))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func joinOrNone(items []string) string {
+	if len(items) == 0 {
+		return "(none)"
+	}
+	return strings.Join(items, ", ")
+}
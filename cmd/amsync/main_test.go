@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/automerge/automerge-go"
+
+	"github.com/astromechza/automerge-ndjson-sync"
+)
+
+func TestWriteChanges(t *testing.T) {
+	doc := automerge.New()
+	if err := doc.RootMap().Set("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := doc.Commit("first")
+	if err := doc.RootMap().Set("a", "c"); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := doc.Commit("second")
+
+	buff := new(bytes.Buffer)
+	if err := writeChanges(buff, doc, []automerge.ChangeHash{first}); err != nil {
+		t.Fatal(err)
+	}
+	var out changeOutput
+	dec := json.NewDecoder(buff)
+	if err := dec.Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Hash != second.String() || out.Message != "second" || out.Seq != 2 || out.Actor != doc.ActorID() {
+		t.Errorf("unexpected change %+v", out)
+	}
+	if dec.More() {
+		t.Errorf("expected only the change since the given heads")
+	}
+}
+
+func TestPullAndPush(t *testing.T) {
+	serverDoc := automergendjsonsync.NewSharedDoc(automerge.New())
+	if err := serverDoc.Doc().RootMap().Set("server", "a"); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = serverDoc.Doc().Commit("server change")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = serverDoc.ServeChanges(w, r)
+	}))
+	defer server.Close()
+
+	// the file to pull into already has a local change
+	local := automerge.New()
+	if err := local.RootMap().Set("local", "b"); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = local.Commit("local change")
+	path := filepath.Join(t.TempDir(), "doc.automerge")
+	if err := saveDoc(path, local); err != nil {
+		t.Fatal(err)
+	}
+
+	serverHeads := serverDoc.Doc().Heads()
+	if err := mainInner([]string{"pull", "-o", path, server.URL}); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(serverDoc.Doc().Heads(), serverHeads) {
+		t.Errorf("pull changed the server heads")
+	}
+	pulled, err := loadDoc(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values, _ := pulled.RootMap().Values(); values["server"].Str() != "a" || values["local"].Str() != "b" {
+		t.Errorf("expected the pulled doc to have both changes, got %v", pulled.Root().Interface())
+	}
+
+	if err := mainInner([]string{"push", "-i", path, server.URL}); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(serverDoc.Doc().Heads(), pulled.Heads()) {
+		t.Errorf("push did not send the local change")
+	}
+}
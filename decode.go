@@ -0,0 +1,190 @@
+package automergendjsonsync
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/automerge/automerge-go"
+)
+
+// DecodedSyncMessage is a readable summary of a single message from a captured sync stream.
+type DecodedSyncMessage struct {
+	// Index is the 1-based position of the message in the stream.
+	Index int `json:"index"`
+	// Event is the event name of the message. Only EventSync messages have the remaining fields populated, apart from
+	// EventAck messages which have the persisted heads.
+	Event string `json:"event"`
+	// Bytes is the size of the message on the wire.
+	Bytes   int             `json:"bytes"`
+	Heads   []string        `json:"heads,omitempty"`
+	Need    []string        `json:"need,omitempty"`
+	Have    []DecodedHave   `json:"have,omitempty"`
+	Changes []DecodedChange `json:"changes,omitempty"`
+}
+
+// DecodedHave summarises a "have" entry of a sync message. The bloom filter itself is opaque, so only its size is
+// reported.
+type DecodedHave struct {
+	LastSync   []string `json:"last_sync"`
+	BloomBytes int      `json:"bloom_bytes"`
+}
+
+// DecodedChange summarises a change carried in a sync message.
+type DecodedChange struct {
+	Hash         string    `json:"hash"`
+	Actor        string    `json:"actor"`
+	Seq          uint64    `json:"seq"`
+	Message      string    `json:"message,omitempty"`
+	Timestamp    time.Time `json:"timestamp"`
+	Dependencies []string  `json:"dependencies,omitempty"`
+}
+
+// DecodeSyncStream reads a captured stream of messages in the given content type, such as the output of curl against
+// ServeChanges, and calls visit with a decoded summary of each message in order. Reading stops at the end of the
+// stream, or at the first error returned by visit.
+func DecodeSyncStream(contentType string, r io.Reader, visit func(m *DecodedSyncMessage) error) error {
+	ct, ok := suitableContentType(contentType)
+	if !ok {
+		return fmt.Errorf("unsupported content type '%s'", contentType)
+	}
+	reader := newMessageReader(ct, r)
+	for i := 1; ; i++ {
+		e, n, err := reader.ReadMessage()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read message %d: %w", i, err)
+		}
+		decoded := &DecodedSyncMessage{Index: i, Event: e.Event, Bytes: n}
+		if e.Event == EventSync {
+			if err := decodeSyncMessage(e.Data, decoded); err != nil {
+				return fmt.Errorf("failed to decode message %d: %w", i, err)
+			}
+		} else if e.Event == EventAck {
+			heads, err := decodeAckHeads(e.Data)
+			if err != nil {
+				return fmt.Errorf("failed to decode message %d: %w", i, err)
+			}
+			decoded.Heads = changeHashStrings(heads)
+		}
+		if err := visit(decoded); err != nil {
+			return err
+		}
+	}
+}
+
+func decodeSyncMessage(raw []byte, into *DecodedSyncMessage) error {
+	m, err := automerge.LoadSyncMessage(raw)
+	if err != nil {
+		return err
+	}
+	need, have, _, err := parseSyncMessageNeedHave(raw)
+	if err != nil {
+		return err
+	}
+	into.Heads = changeHashStrings(m.Heads())
+	into.Need = changeHashStrings(need)
+	for _, h := range have {
+		lastSync := changeHashStrings(h.lastSync)
+		if lastSync == nil {
+			lastSync = []string{}
+		}
+		into.Have = append(into.Have, DecodedHave{LastSync: lastSync, BloomBytes: h.bloomBytes})
+	}
+	for _, c := range m.Changes() {
+		into.Changes = append(into.Changes, DecodedChange{
+			Hash:         c.Hash().String(),
+			Actor:        c.ActorID(),
+			Seq:          c.ActorSeq(),
+			Message:      c.Message(),
+			Timestamp:    c.Timestamp(),
+			Dependencies: changeHashStrings(c.Dependencies()),
+		})
+	}
+	return nil
+}
+
+func changeHashStrings(hashes []automerge.ChangeHash) []string {
+	if len(hashes) == 0 {
+		return nil
+	}
+	out := make([]string, len(hashes))
+	for i, h := range hashes {
+		out[i] = h.String()
+	}
+	return out
+}
+
+// syncMessageHave is the part of a "have" entry we can decode without access to the bloom filter internals.
+type syncMessageHave struct {
+	lastSync   []automerge.ChangeHash
+	bloomBytes int
+}
+
+// syncMessageType is the leading byte of an encoded sync message.
+const syncMessageType = 0x42
+
+// parseSyncMessageNeedHave extracts the need and have sections of an encoded sync message since the automerge
+// bindings only expose the heads and changes. The encoding is the message type byte, followed by the heads and need
+// as uleb128 counted lists of 32 byte hashes, followed by a counted list of have entries, each of which is a hash
+// list and a length prefixed bloom filter. The changes follow, starting at the returned offset.
+func parseSyncMessageNeedHave(raw []byte) ([]automerge.ChangeHash, []syncMessageHave, int, error) {
+	if len(raw) == 0 || raw[0] != syncMessageType {
+		return nil, nil, 0, fmt.Errorf("not a sync message")
+	}
+	rest := raw[1:]
+	readUvarint := func() (uint64, error) {
+		v, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return 0, fmt.Errorf("truncated sync message")
+		}
+		rest = rest[n:]
+		return v, nil
+	}
+	readHashes := func() ([]automerge.ChangeHash, error) {
+		count, err := readUvarint()
+		if err != nil {
+			return nil, err
+		} else if count > uint64(len(rest)/32) {
+			return nil, fmt.Errorf("truncated sync message")
+		}
+		hashes := make([]automerge.ChangeHash, count)
+		for i := range hashes {
+			copy(hashes[i][:], rest[:32])
+			rest = rest[32:]
+		}
+		return hashes, nil
+	}
+
+	if _, err := readHashes(); err != nil {
+		return nil, nil, 0, err
+	}
+	need, err := readHashes()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	haveCount, err := readUvarint()
+	if err != nil {
+		return nil, nil, 0, err
+	} else if haveCount > uint64(len(rest)) {
+		return nil, nil, 0, fmt.Errorf("truncated sync message")
+	}
+	have := make([]syncMessageHave, haveCount)
+	for i := range have {
+		if have[i].lastSync, err = readHashes(); err != nil {
+			return nil, nil, 0, err
+		}
+		size, err := readUvarint()
+		if err != nil {
+			return nil, nil, 0, err
+		} else if size > uint64(len(rest)) {
+			return nil, nil, 0, fmt.Errorf("truncated sync message")
+		}
+		have[i].bloomBytes = int(size)
+		rest = rest[size:]
+	}
+	return need, have, len(raw) - len(rest), nil
+}
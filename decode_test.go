@@ -0,0 +1,109 @@
+package automergendjsonsync
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/automerge/automerge-go"
+)
+
+func TestDecodeSyncStream(t *testing.T) {
+	t.Parallel()
+	docA := automerge.New()
+	assertEqual(t, docA.RootMap().Set("a", 1), nil)
+	hash, err := docA.Commit("first change")
+	assertEqual(t, err, nil)
+	stateA, stateB := automerge.NewSyncState(docA), automerge.NewSyncState(automerge.New())
+
+	// capture the messages that A sends to B as they would appear on the wire
+	buff := new(bytes.Buffer)
+	w := newMessageWriter(ContentType, buff)
+	for i := 0; i < 3; i++ {
+		if m, ok := stateA.GenerateMessage(); ok {
+			_, err := w.WriteMessage(&NdJson{Event: EventSync, Data: m.Bytes()})
+			assertEqual(t, err, nil)
+			_, err = stateB.ReceiveMessage(m.Bytes())
+			assertEqual(t, err, nil)
+		}
+		if m, ok := stateB.GenerateMessage(); ok {
+			_, err = stateA.ReceiveMessage(m.Bytes())
+			assertEqual(t, err, nil)
+		}
+	}
+	_, err = w.WriteMessage(&NdJson{Event: "other"})
+	assertEqual(t, err, nil)
+	otherEnd := buff.Len()
+	_, err = w.WriteMessage(&NdJson{Event: EventAck, Data: encodeAckHeads([]automerge.ChangeHash{hash})})
+	assertEqual(t, err, nil)
+
+	var decoded []*DecodedSyncMessage
+	assertEqual(t, DecodeSyncStream(ContentType, bytes.NewReader(buff.Bytes()), func(m *DecodedSyncMessage) error {
+		decoded = append(decoded, m)
+		return nil
+	}), nil)
+	assertEqual(t, len(decoded), 4)
+
+	first := decoded[0]
+	assertEqual(t, first.Index, 1)
+	assertEqual(t, first.Event, EventSync)
+	assertEqual(t, first.Heads, []string{hash.String()})
+	assertEqual(t, len(first.Have), 1)
+	assertEqual(t, len(first.Changes), 0)
+
+	second := decoded[1]
+	assertEqual(t, len(second.Changes), 1)
+	assertEqual(t, second.Changes[0].Hash, hash.String())
+	assertEqual(t, second.Changes[0].Actor, docA.ActorID())
+	assertEqual(t, second.Changes[0].Seq, uint64(1))
+	assertEqual(t, second.Changes[0].Message, "first change")
+
+	assertEqual(t, decoded[2], &DecodedSyncMessage{Index: 3, Event: "other", Bytes: otherEnd - first.Bytes - second.Bytes})
+	assertEqual(t, decoded[3], &DecodedSyncMessage{Index: 4, Event: EventAck, Bytes: buff.Len() - otherEnd, Heads: []string{hash.String()}})
+}
+
+func TestDecodeSyncStream_errors(t *testing.T) {
+	t.Parallel()
+
+	t.Run("bad content type", func(t *testing.T) {
+		assertErrorEqual(t, DecodeSyncStream("text/plain", bytes.NewReader(nil), nil), "unsupported content type 'text/plain'")
+	})
+
+	t.Run("bad sync message", func(t *testing.T) {
+		err := DecodeSyncStream(ContentType, bytes.NewBufferString(`{"event":"sync","data":"AQID"}`+"\n"), nil)
+		assertEqual(t, err != nil, true)
+	})
+
+	t.Run("bad ack", func(t *testing.T) {
+		err := DecodeSyncStream(ContentType, bytes.NewBufferString(`{"event":"ack","data":"AQID"}`+"\n"), func(m *DecodedSyncMessage) error {
+			return nil
+		})
+		assertErrorEqual(t, err, "failed to decode message 1: ack data is not a list of change hashes")
+	})
+
+	t.Run("visit error", func(t *testing.T) {
+		err := DecodeSyncStream(ContentType, bytes.NewBufferString(`{"event":"other"}`+"\n"), func(m *DecodedSyncMessage) error {
+			return errors.New("stop")
+		})
+		assertErrorEqual(t, err, "stop")
+	})
+}
+
+func TestParseSyncMessageNeedHave(t *testing.T) {
+	t.Parallel()
+	var h automerge.ChangeHash
+	h[0] = 7
+	raw := []byte{syncMessageType, 0, 1}
+	raw = append(raw, h[:]...)
+	raw = append(raw, 1, 1)
+	raw = append(raw, h[:]...)
+	raw = append(raw, 3, 9, 9, 9, 0)
+	need, have, changesAt, err := parseSyncMessageNeedHave(raw)
+	assertEqual(t, err, nil)
+	assertEqual(t, need, []automerge.ChangeHash{h})
+	assertEqual(t, have, []syncMessageHave{{lastSync: []automerge.ChangeHash{h}, bloomBytes: 3}})
+	assertEqual(t, changesAt, len(raw)-1)
+
+	_, _, _, err = parseSyncMessageNeedHave(raw[:10])
+	assertErrorEqual(t, err, "truncated sync message")
+}
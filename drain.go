@@ -0,0 +1,80 @@
+package automergendjsonsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/automerge/automerge-go"
+)
+
+// ErrPeerGoodbye is returned when the other end sent EventGoodbye because it is draining. The sync should be
+// reconnected, possibly to another server.
+var ErrPeerGoodbye = errors.New("peer said goodbye")
+
+// Drain gracefully ends every ServeChanges and HttpPushPullChanges session of the doc, such as when a server is
+// shutting down. New sessions are refused from then on, with a 503 Service Unavailable for ServeChanges. Each active
+// session flushes its outstanding messages and sends EventGoodbye, after which a well-behaved peer closes its side of
+// the stream. Drain returns once every session has ended. If the context is done first, the remaining sessions are
+// disconnected and the context error is returned. Since http.Server.Shutdown waits for the handlers to return, call
+// this from http.Server.RegisterOnShutdown so that shutdowns don't stall on open streams.
+func (b *SharedDoc) Drain(ctx context.Context) error {
+	b.mutex.Lock()
+	b.draining = true
+	b.mutex.Unlock()
+
+	sessions := b.liveSessions()
+	for _, s := range sessions {
+		s.startDrain()
+	}
+	for _, s := range sessions {
+		select {
+		case <-s.done:
+		case <-ctx.Done():
+			for _, s := range sessions {
+				s.cancel(ErrSessionDisconnected)
+			}
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Drain drains every doc in the repo concurrently, see SharedDoc.Drain.
+func (r *Repo) Drain(ctx context.Context) error {
+	errs := make([]error, 0)
+	mutex := new(sync.Mutex)
+	wg := new(sync.WaitGroup)
+	for _, id := range r.Ids() {
+		doc, _ := r.Get(id)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := doc.Drain(ctx); err != nil {
+				mutex.Lock()
+				defer mutex.Unlock()
+				errs = append(errs, fmt.Errorf("failed to drain doc '%s': %w", id, err))
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// writeGoodbye writes any messages that are outstanding for the sync state followed by EventGoodbye.
+func writeGoodbye(state *automerge.SyncState, writer messageWriter) error {
+	for {
+		m, ok := state.GenerateMessage()
+		if !ok {
+			break
+		}
+		if _, err := writer.WriteMessage(newSyncMessageLine(m)); err != nil {
+			return fmt.Errorf("failed to write message: %w", err)
+		}
+	}
+	if _, err := writer.WriteMessage(&NdJson{Event: EventGoodbye}); err != nil {
+		return fmt.Errorf("failed to write goodbye: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package automergendjsonsync
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/automerge/automerge-go"
+)
+
+func TestDrain(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	serverDoc := NewSharedDoc(automerge.New())
+	assertEqual(t, serverDoc.Doc().RootMap().Set("a", "b"), nil)
+	_, _ = serverDoc.Doc().Commit("change")
+	serveErrs := make(chan error, 1)
+	url := startTestServer(t, &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveErrs <- serverDoc.ServeChanges(w, r)
+	})})
+
+	clientDoc := NewSharedDoc(automerge.New())
+	clientErrs := make(chan error, 1)
+	go func() {
+		clientErrs <- clientDoc.HttpPushPullChanges(ctx, url)
+	}()
+	waitForSession(t, serverDoc)
+
+	// a change that nothing has been notified about yet is flushed before the goodbye
+	assertEqual(t, serverDoc.Doc().RootMap().Set("c", "d"), nil)
+	_, _ = serverDoc.Doc().Commit("change")
+	assertEqual(t, serverDoc.Drain(ctx), nil)
+	assertEqual(t, <-serveErrs, nil)
+	assertEqual(t, errors.Is(<-clientErrs, ErrPeerGoodbye), true)
+	assertEqual(t, clientDoc.Doc().Heads(), serverDoc.Doc().Heads())
+	assertEqual(t, len(serverDoc.Sessions()), 0)
+
+	// new sessions are refused once draining
+	err := clientDoc.HttpPushPullChanges(ctx, url)
+	assertErrorEqual(t, err, "http request failed with status 503")
+	assertEqual(t, <-serveErrs, nil)
+}
+
+func TestDrain_client(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	serverDoc := NewSharedDoc(automerge.New())
+	serveErrs := make(chan error, 1)
+	url := startTestServer(t, &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveErrs <- serverDoc.ServeChanges(w, r)
+	})})
+
+	clientDoc := NewSharedDoc(automerge.New())
+	clientErrs := make(chan error, 1)
+	go func() {
+		clientErrs <- clientDoc.HttpPushPullChanges(ctx, url)
+	}()
+	waitForSession(t, clientDoc)
+
+	assertEqual(t, clientDoc.Doc().RootMap().Set("a", "b"), nil)
+	_, _ = clientDoc.Doc().Commit("change")
+	assertEqual(t, clientDoc.Drain(ctx), nil)
+	// the server ends the response when the client says goodbye
+	assertEqual(t, <-clientErrs, nil)
+	assertEqual(t, <-serveErrs, nil)
+	assertEqual(t, serverDoc.Doc().Heads(), clientDoc.Doc().Heads())
+	assertErrorEqual(t, clientDoc.HttpPushPullChanges(ctx, url), "the doc is draining")
+}
+
+func TestDrain_timeout(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	serverDoc := NewSharedDoc(automerge.New())
+	serveErrs := make(chan error, 1)
+	url := startTestServer(t, &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveErrs <- serverDoc.ServeChanges(w, r)
+	})})
+
+	// a badly behaved client that never closes the request body
+	body, bodyWriter := io.Pipe()
+	defer bodyWriter.Close()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPut, url, body)
+	// without this the http client buffers the request headers until the body has been written
+	req.Header.Set("Expect", "100-continue")
+	go func() {
+		_, _ = bodyWriter.Write([]byte("{\"event\":\"sync\",\"data\":\"QgAAAQAAAA==\"}\n"))
+	}()
+	res, err := http.DefaultClient.Do(req)
+	assertEqual(t, err, nil)
+	defer res.Body.Close()
+
+	drainCtx, drainCancel := context.WithTimeout(ctx, time.Millisecond*100)
+	defer drainCancel()
+	assertEqual(t, errors.Is(serverDoc.Drain(drainCtx), context.DeadlineExceeded), true)
+	assertEqual(t, <-serveErrs, nil)
+	assertEqual(t, len(serverDoc.Sessions()), 0)
+}
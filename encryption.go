@@ -0,0 +1,133 @@
+package automergendjsonsync
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+)
+
+// Keyring holds the shared symmetric keys used to encrypt the data of each message with AES-GCM, so that servers
+// relaying the messages can't read the document content. Each key has an id which is sent along with the encrypted
+// data, so keys can be rotated by adding a new current key while keeping the old keys until every peer has moved on.
+type Keyring struct {
+	currentId string
+	aeads     map[string]cipher.AEAD
+}
+
+// NewKeyring returns a keyring that encrypts with the key named currentId and decrypts with any of the given keys.
+// Keys must be 16, 24, or 32 bytes long to select AES-128, AES-192, or AES-256.
+func NewKeyring(currentId string, keys map[string][]byte) (*Keyring, error) {
+	if _, ok := keys[currentId]; !ok {
+		return nil, fmt.Errorf("current key id '%s' is not in the keys", currentId)
+	}
+	k := &Keyring{currentId: currentId, aeads: make(map[string]cipher.AEAD, len(keys))}
+	for id, key := range keys {
+		if id == "" {
+			return nil, fmt.Errorf("key id must not be empty")
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key '%s': %w", id, err)
+		}
+		if k.aeads[id], err = cipher.NewGCM(block); err != nil {
+			return nil, fmt.Errorf("invalid key '%s': %w", id, err)
+		}
+	}
+	return k, nil
+}
+
+// additionalData binds the ciphertext to the event and key id so that neither can be swapped by a relay.
+func additionalData(e *NdJson, keyId string) []byte {
+	return []byte(e.Event + "\x00" + keyId)
+}
+
+// encrypt returns a copy of the message with the data encrypted by the current key. The nonce is prepended to the
+// ciphertext. Messages without data are returned as is.
+func (k *Keyring) encrypt(e *NdJson) (*NdJson, error) {
+	if len(e.Data) == 0 {
+		return e, nil
+	}
+	aead := k.aeads[k.currentId]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(e.Data)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	out := *e
+	out.Data, out.KeyId = aead.Seal(nonce, nonce, e.Data, additionalData(e, k.currentId)), k.currentId
+	return &out, nil
+}
+
+// decrypt returns a copy of the message with the data decrypted. Messages with data must be encrypted, since
+// accepting plain messages would let a relay inject changes.
+func (k *Keyring) decrypt(e *NdJson) (*NdJson, error) {
+	if len(e.Data) == 0 {
+		return e, nil
+	} else if e.KeyId == "" {
+		return nil, fmt.Errorf("message is not encrypted")
+	}
+	aead, ok := k.aeads[e.KeyId]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id '%s'", e.KeyId)
+	} else if len(e.Data) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted data is too short")
+	}
+	nonce, ciphertext := e.Data[:aead.NonceSize()], e.Data[aead.NonceSize():]
+	data, err := aead.Open(nil, nonce, ciphertext, additionalData(e, e.KeyId))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt message with key '%s': %w", e.KeyId, err)
+	}
+	out := *e
+	out.Data, out.KeyId = data, ""
+	return &out, nil
+}
+
+type decryptingReader struct {
+	reader  messageReader
+	keyring *Keyring
+}
+
+func (r *decryptingReader) ReadMessage() (*NdJson, int, error) {
+	e, n, err := r.reader.ReadMessage()
+	if err != nil {
+		return e, n, err
+	}
+	if e, err = r.keyring.decrypt(e); err != nil {
+		return nil, 0, &malformedMessageError{err: err}
+	}
+	return e, n, nil
+}
+
+type encryptingWriter struct {
+	writer  messageWriter
+	keyring *Keyring
+}
+
+func (w *encryptingWriter) WriteMessage(e *NdJson) (int, error) {
+	e, err := w.keyring.encrypt(e)
+	if err != nil {
+		return 0, err
+	}
+	return w.writer.WriteMessage(e)
+}
+
+func (w *encryptingWriter) Close() error {
+	return closeWriter(w.writer)
+}
+
+// encryptReader wraps the reader so that each message is decrypted with the keyring, if there is one.
+func encryptReader(keyring *Keyring, reader messageReader) messageReader {
+	if keyring == nil {
+		return reader
+	}
+	return &decryptingReader{reader: reader, keyring: keyring}
+}
+
+// encryptWriter wraps the writer so that each message is encrypted with the keyring, if there is one.
+func encryptWriter(keyring *Keyring, writer messageWriter) messageWriter {
+	if keyring == nil {
+		return writer
+	}
+	return &encryptingWriter{writer: writer, keyring: keyring}
+}
@@ -13,11 +13,11 @@ import (
 	"net"
 	"net/http"
 	"os"
-	"sync"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
-	"github.com/automerge/automerge-go"
-
 	"github.com/astromechza/automerge-ndjson-sync"
 )
 
@@ -51,6 +51,11 @@ func (c *CommitingResponseWriter) Flush() {
 	c.committed = true
 }
 
+// Unwrap allows http.ResponseController to reach the underlying response writer.
+func (c *CommitingResponseWriter) Unwrap() http.ResponseWriter {
+	return c.inner
+}
+
 func (c *CommitingResponseWriter) Committed() bool {
 	return c.committed
 }
@@ -79,27 +84,31 @@ func handlerWithErrors(inner func(writer http.ResponseWriter, request *http.Requ
 func mainInner() error {
 	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})))
 
-	m := new(sync.Map)
+	repo := automergendjsonsync.NewRepo()
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("GET /{id}", handlerWithErrors(func(writer http.ResponseWriter, request *http.Request) error {
-		docId := request.PathValue("id")
-		docAny, ok := m.Load(docId)
-		if !ok {
-			return fmt.Errorf("document not found")
-		}
-		docShared := docAny.(*automergendjsonsync.SharedDoc)
-		writer.Header().Set("Content-Type", "application/octet-stream")
-		writer.WriteHeader(http.StatusOK)
-		_, err := writer.Write(docShared.Doc().Save())
-		return err
+	withDoc := func(inner func(doc *automergendjsonsync.SharedDoc, writer http.ResponseWriter, request *http.Request) error) http.HandlerFunc {
+		return handlerWithErrors(func(writer http.ResponseWriter, request *http.Request) error {
+			docShared, ok := repo.Get(request.PathValue("id"))
+			if !ok {
+				http.NotFound(writer, request)
+				return nil
+			}
+			return inner(docShared, writer, request)
+		})
+	}
+	mux.HandleFunc("GET /{id}", withDoc((*automergendjsonsync.SharedDoc).ServeSnapshot))
+	mux.HandleFunc("GET /{id}/heads", withDoc((*automergendjsonsync.SharedDoc).ServeHeads))
+	mux.HandleFunc("GET /{id}/changes", withDoc((*automergendjsonsync.SharedDoc).ServeChangesSince))
+	// The sessions of each doc can be listed and disconnected. A real server would protect this with authentication.
+	mux.HandleFunc("/{id}/sessions", withDoc(func(doc *automergendjsonsync.SharedDoc, writer http.ResponseWriter, request *http.Request) error {
+		doc.SessionsHandler().ServeHTTP(writer, request)
+		return nil
 	}))
 
 	mux.HandleFunc("PUT /{id}", handlerWithErrors(func(writer http.ResponseWriter, request *http.Request) error {
 		docId := request.PathValue("id")
-		docAny, _ := m.LoadOrStore(docId, automergendjsonsync.NewSharedDoc(automerge.New()))
-		docShared := docAny.(*automergendjsonsync.SharedDoc)
-		return docShared.ServeChanges(writer, request)
+		return repo.GetOrCreate(docId).ServeChanges(writer, request)
 	}))
 
 	// we want both http1 and http2 here. For http2 we need a tls cert.
@@ -117,8 +126,41 @@ func mainInner() error {
 			return automergendjsonsync.SetContextLogger(context.Background(), slog.Default())
 		},
 	}
+	// Optionally replicate every document to a comma separated list of upstream servers. The upstream servers use
+	// self-signed certificates too.
+	if v := os.Getenv("UPSTREAMS"); v != "" {
+		hc := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+		go func() {
+			_ = repo.Replicate(server.BaseContext(nil), strings.Split(v, ","), automergendjsonsync.WithReplicationClientOptions(automergendjsonsync.WithHttpClient(hc)))
+		}()
+	}
+
+	// Shutdown waits for the handlers to return, but sync streams only end when the client hangs up, so the docs are
+	// drained to end them gracefully.
+	server.RegisterOnShutdown(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := repo.Drain(ctx); err != nil {
+			slog.Default().Warn("failed to drain docs", slog.Any("err", err))
+		}
+	})
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	slog.Default().Info("listening and serving")
-	return server.ListenAndServeTLS("", "")
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServeTLS("", "")
+	}()
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+	slog.Default().Info("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return server.Shutdown(shutdownCtx)
 }
 
 func generateSelfSignedCert() (*tls.Certificate, error) {
@@ -2,7 +2,6 @@ package automergendjsonsync
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"log/slog"
 	"net"
@@ -30,16 +29,8 @@ func Test_sync3(t *testing.T) {
 		}
 	})
 
-	listener, err := net.Listen("tcp", "127.0.0.1:0")
-	assertEqual(t, err, nil)
-	server := &http.Server{Handler: mux}
-	defer server.Close()
+	serverUrl := startTestServer(t, &http.Server{Handler: mux})
 	goErrors := make(chan error, 3)
-	go func() {
-		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			panic(err)
-		}
-	}()
 
 	peerDocs := make([]*SharedDoc, 0)
 	wg := new(sync.WaitGroup)
@@ -52,7 +43,7 @@ func Test_sync3(t *testing.T) {
 		_, _ = peerDoc.Doc().Commit("change")
 		go func() {
 			defer wg.Done()
-			if err := peerDoc.HttpPushPullChanges(context.Background(), "http://"+listener.Addr().String(), WithClientTerminationCheck(func(doc *automerge.Doc, m *automerge.SyncMessage) bool {
+			if err := peerDoc.HttpPushPullChanges(context.Background(), serverUrl, WithClientTerminationCheck(func(doc *automerge.Doc, m *automerge.SyncMessage) bool {
 				return len(doc.Heads()) == 3
 			})); err != nil {
 				goErrors <- err
@@ -79,6 +70,33 @@ func Test_sync3(t *testing.T) {
 	assertEqual(t, values["peer-1"].Int64(), 1)
 }
 
+// The binary framing should sync just as well as the default NdJson framing.
+func TestExample_BinaryFraming(t *testing.T) {
+	t.Parallel()
+
+	sd := NewSharedDoc(automerge.New())
+	assertEqual(t, sd.Doc().RootMap().Set("a", "b"), nil)
+	_, _ = sd.Doc().Commit("change")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		assertEqual(t, r.Header.Get("Content-Type"), ContentTypeBinary)
+		if err := sd.ServeChanges(w, r); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	serverUrl := startTestServer(t, &http.Server{Handler: mux})
+
+	peerDoc := NewSharedDoc(automerge.New())
+	assertEqual(t, peerDoc.Doc().RootMap().Set("c", "d"), nil)
+	_, _ = peerDoc.Doc().Commit("change")
+	assertEqual(t, peerDoc.HttpPushPullChanges(context.Background(), serverUrl, WithClientContentType(ContentTypeBinary), WithClientTerminationCheck(func(doc *automerge.Doc, m *automerge.SyncMessage) bool {
+		return len(doc.Heads()) == 2 && HeadsEqualCheck(doc, m)
+	})), nil)
+	assertEqual(t, peerDoc.Doc().RootMap().Len(), 2)
+}
+
 // It's very useful to be able to load balance clients via HTTP redirect semantics.
 func TestExample_HttpRedirect(t *testing.T) {
 	t.Parallel()
@@ -101,18 +119,10 @@ func TestExample_HttpRedirect(t *testing.T) {
 		}
 	})
 
-	listener, err := net.Listen("tcp", "127.0.0.1:0")
-	assertEqual(t, err, nil)
-	server := &http.Server{Handler: mux, BaseContext: func(listener net.Listener) context.Context {
+	serverUrl := startTestServer(t, &http.Server{Handler: mux, BaseContext: func(listener net.Listener) context.Context {
 		return ctx
-	}}
-	defer server.Close()
-	go func() {
-		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			panic(err)
-		}
-	}()
+	}})
 
 	peerDoc := NewSharedDoc(automerge.New())
-	assertEqual(t, peerDoc.HttpPushPullChanges(ctx, "http://"+listener.Addr().String(), WithClientTerminationCheck(HasAllRemoteHeads)), nil)
+	assertEqual(t, peerDoc.HttpPushPullChanges(ctx, serverUrl, WithClientTerminationCheck(HasAllRemoteHeads)), nil)
 }
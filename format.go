@@ -0,0 +1,309 @@
+package automergendjsonsync
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The binary framing has an event-type byte for common events. Any other event is written with binaryEventNamed and
+// carries its name in a binaryFieldEvent field, so new events never need a new byte to be understood by binary peers.
+// Frames with an unknown event byte are skipped.
+const (
+	binaryEventNamed byte = 0
+	binaryEventSync  byte = 1
+)
+
+// Each field in a binary frame is introduced by a tag byte. Fields with an unknown tag are skipped.
+const (
+	binaryFieldData   byte = 1
+	binaryFieldEvent  byte = 2
+	binaryFieldKeyId  byte = 3
+	binaryFieldSig    byte = 4
+	binaryFieldSigner byte = 5
+)
+
+// maxBinaryFrameSize bounds the size of a single binary frame so that a bad length prefix can't cause us to allocate
+// an unbounded amount of memory.
+const maxBinaryFrameSize = 64 << 20
+
+var binaryEvents = map[string]byte{
+	EventSync: binaryEventSync,
+}
+
+// malformedMessageError is returned by a messageReader when a message could be read off the stream but could not be
+// decoded. This allows callers to distinguish bad content from a failing stream.
+type malformedMessageError struct {
+	err error
+}
+
+func (e *malformedMessageError) Error() string {
+	return e.err.Error()
+}
+
+func (e *malformedMessageError) Unwrap() error {
+	return e.err
+}
+
+// A messageReader reads messages from a stream in a particular wire format.
+type messageReader interface {
+	// ReadMessage returns the next message and the number of bytes it occupied on the wire. io.EOF is returned when
+	// the stream is complete.
+	ReadMessage() (*NdJson, int, error)
+}
+
+// A messageWriter writes messages to a stream in a particular wire format.
+type messageWriter interface {
+	// WriteMessage writes the message and returns the number of bytes written to the wire.
+	WriteMessage(e *NdJson) (int, error)
+}
+
+// newMessageReader returns a messageReader for the given content type. The content type must already have been
+// validated as supported.
+func newMessageReader(contentType string, reader io.Reader) messageReader {
+	if contentType == ContentTypeBinary {
+		return &binaryReader{reader: bufio.NewReader(reader)}
+	}
+	return &ndJsonReader{scanner: bufio.NewScanner(reader)}
+}
+
+// newMessageWriter returns a messageWriter for the given content type. The content type must already have been
+// validated as supported.
+func newMessageWriter(contentType string, writer io.Writer) messageWriter {
+	if contentType == ContentTypeBinary {
+		return &binaryWriter{writer: writer}
+	}
+	return &ndJsonWriter{writer: writer}
+}
+
+type ndJsonReader struct {
+	scanner *bufio.Scanner
+}
+
+func (r *ndJsonReader) ReadMessage() (*NdJson, int, error) {
+	if !r.scanner.Scan() {
+		if r.scanner.Err() != nil {
+			return nil, 0, r.scanner.Err()
+		}
+		return nil, 0, io.EOF
+	}
+	e := &NdJson{}
+	if err := json.Unmarshal(r.scanner.Bytes(), e); err != nil {
+		return nil, 0, &malformedMessageError{err: err}
+	}
+	return e, len(r.scanner.Bytes()) + 1, nil
+}
+
+type ndJsonWriter struct {
+	writer io.Writer
+}
+
+func (w *ndJsonWriter) WriteMessage(e *NdJson) (int, error) {
+	r, err := json.Marshal(e)
+	if err != nil {
+		return 0, err
+	}
+	r = append(r, '\n')
+	n, err := w.writer.Write(r)
+	if err == nil {
+		flushWriter(w.writer)
+	}
+	return n, err
+}
+
+func (w *ndJsonWriter) Close() error {
+	return closeWriter(w.writer)
+}
+
+type binaryReader struct {
+	reader *bufio.Reader
+}
+
+func (r *binaryReader) ReadMessage() (*NdJson, int, error) {
+	for {
+		size, err := binary.ReadUvarint(r.reader)
+		if err != nil {
+			return nil, 0, err
+		} else if size == 0 || size > maxBinaryFrameSize {
+			return nil, 0, &malformedMessageError{err: fmt.Errorf("invalid frame size %d", size)}
+		}
+		frame := make([]byte, size)
+		if _, err := io.ReadFull(r.reader, frame); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, 0, err
+		}
+		e, err := decodeBinaryFrame(frame)
+		if err != nil {
+			return nil, 0, &malformedMessageError{err: err}
+		} else if e == nil {
+			// unknown event type, skip it
+			continue
+		}
+		return e, uvarintLen(size) + len(frame), nil
+	}
+}
+
+func decodeBinaryFrame(frame []byte) (*NdJson, error) {
+	e := &NdJson{}
+	switch frame[0] {
+	case binaryEventNamed:
+	case binaryEventSync:
+		e.Event = EventSync
+	default:
+		return nil, nil
+	}
+	rest := frame[1:]
+	for len(rest) > 0 {
+		tag := rest[0]
+		size, n := binary.Uvarint(rest[1:])
+		if n <= 0 || size > uint64(len(rest)-1-n) {
+			return nil, fmt.Errorf("invalid length for field %d", tag)
+		}
+		value := rest[1+n : 1+n+int(size)]
+		rest = rest[1+n+int(size):]
+		switch tag {
+		case binaryFieldData:
+			e.Data = value
+		case binaryFieldEvent:
+			if frame[0] == binaryEventNamed {
+				e.Event = string(value)
+			}
+		case binaryFieldKeyId:
+			e.KeyId = string(value)
+		case binaryFieldSig:
+			e.Signature = value
+		case binaryFieldSigner:
+			e.SignerId = string(value)
+		}
+	}
+	if e.Event == "" {
+		return nil, fmt.Errorf("frame has no event name")
+	}
+	return e, nil
+}
+
+type binaryWriter struct {
+	writer io.Writer
+}
+
+func (w *binaryWriter) WriteMessage(e *NdJson) (int, error) {
+	event, ok := binaryEvents[e.Event]
+	if !ok {
+		event = binaryEventNamed
+	}
+	body := []byte{event}
+	if event == binaryEventNamed {
+		body = appendBinaryField(body, binaryFieldEvent, []byte(e.Event))
+	}
+	if e.KeyId != "" {
+		body = appendBinaryField(body, binaryFieldKeyId, []byte(e.KeyId))
+	}
+	if len(e.Signature) > 0 {
+		body = appendBinaryField(body, binaryFieldSig, e.Signature)
+		body = appendBinaryField(body, binaryFieldSigner, []byte(e.SignerId))
+	}
+	if len(e.Data) > 0 {
+		body = appendBinaryField(body, binaryFieldData, e.Data)
+	}
+	frame := binary.AppendUvarint(make([]byte, 0, len(body)+binary.MaxVarintLen64), uint64(len(body)))
+	frame = append(frame, body...)
+	n, err := w.writer.Write(frame)
+	if err == nil {
+		flushWriter(w.writer)
+	}
+	return n, err
+}
+
+func (w *binaryWriter) Close() error {
+	return closeWriter(w.writer)
+}
+
+func appendBinaryField(buff []byte, tag byte, value []byte) []byte {
+	buff = append(buff, tag)
+	buff = binary.AppendUvarint(buff, uint64(len(value)))
+	return append(buff, value...)
+}
+
+func uvarintLen(v uint64) int {
+	return len(binary.AppendUvarint(nil, v))
+}
+
+// flushWriter flushes the writer if it supports it, this ensures each message is sent to the peer as soon as possible.
+func flushWriter(writer io.Writer) {
+	if f, ok := writer.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// closeWriter closes the writer, which may be an io.Writer or a messageWriter, if it is also an io.Closer.
+func closeWriter(writer any) error {
+	if v, ok := writer.(io.Closer); ok {
+		return v.Close()
+	}
+	return nil
+}
+
+// suitableContentType returns the supported content type that matches the given Content-Type header value.
+func suitableContentType(in string) (string, bool) {
+	mt, p, err := mime.ParseMediaType(in)
+	if err != nil {
+		return "", false
+	}
+	switch mt {
+	case ContentType:
+		return ContentType, p["charset"] == "" || p["charset"] == "utf-8"
+	case ContentTypeBinary:
+		return ContentTypeBinary, true
+	}
+	return "", false
+}
+
+// negotiateContentType picks the content type to respond with based on an Accept header value which may contain a
+// list of media ranges with quality values. Wildcards match the given default content type, which is generally the
+// content type of the request body.
+func negotiateContentType(accept string, wildcardDefault string) (string, bool) {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mt, p, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := p["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		var candidate string
+		switch mt {
+		case "*/*", "application/*":
+			candidate = wildcardDefault
+		default:
+			var ok bool
+			if candidate, ok = suitableContentType(part); !ok {
+				continue
+			}
+		}
+		if q > bestQ {
+			best, bestQ = candidate, q
+		}
+	}
+	return best, best != ""
+}
+
+// contentTypeHeader returns the full Content-Type header value to send for the given supported content type.
+func contentTypeHeader(contentType string) string {
+	if contentType == ContentType {
+		return ContentTypeWithCharset
+	}
+	return contentType
+}
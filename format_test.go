@@ -0,0 +1,114 @@
+package automergendjsonsync
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestBinaryFraming_round_trip(t *testing.T) {
+	t.Parallel()
+	buff := new(bytes.Buffer)
+	w := newMessageWriter(ContentTypeBinary, buff)
+	n1, err := w.WriteMessage(&NdJson{Event: EventSync, Data: []byte{1, 2, 3}})
+	assertEqual(t, err, nil)
+	n2, err := w.WriteMessage(&NdJson{Event: EventSync})
+	assertEqual(t, err, nil)
+	assertEqual(t, buff.Bytes(), []byte{6, binaryEventSync, binaryFieldData, 3, 1, 2, 3, 1, binaryEventSync})
+	assertEqual(t, n1+n2, buff.Len())
+
+	r := newMessageReader(ContentTypeBinary, buff)
+	e, n, err := r.ReadMessage()
+	assertEqual(t, err, nil)
+	assertEqual(t, e, &NdJson{Event: EventSync, Data: []byte{1, 2, 3}})
+	assertEqual(t, n, n1)
+	e, n, err = r.ReadMessage()
+	assertEqual(t, err, nil)
+	assertEqual(t, e, &NdJson{Event: EventSync})
+	assertEqual(t, n, n2)
+	_, _, err = r.ReadMessage()
+	assertEqual(t, err, io.EOF)
+}
+
+func TestBinaryFraming_skips_unknown(t *testing.T) {
+	t.Parallel()
+	// an unknown event, followed by a sync event with an unknown field 9 before the data
+	buff := bytes.NewBuffer([]byte{2, 200, 0, 8, binaryEventSync, 9, 1, 0, binaryFieldData, 2, 4, 5})
+	e, _, err := newMessageReader(ContentTypeBinary, buff).ReadMessage()
+	assertEqual(t, err, nil)
+	assertEqual(t, e, &NdJson{Event: EventSync, Data: []byte{4, 5}})
+}
+
+func TestBinaryFraming_errors(t *testing.T) {
+	t.Parallel()
+
+	t.Run("truncated frame", func(t *testing.T) {
+		_, _, err := newMessageReader(ContentTypeBinary, bytes.NewBuffer([]byte{5, binaryEventSync})).ReadMessage()
+		assertEqual(t, err, io.ErrUnexpectedEOF)
+	})
+
+	t.Run("bad field length", func(t *testing.T) {
+		_, _, err := newMessageReader(ContentTypeBinary, bytes.NewBuffer([]byte{3, binaryEventSync, binaryFieldData, 5})).ReadMessage()
+		var malformed *malformedMessageError
+		assertEqual(t, errors.As(err, &malformed), true)
+		assertErrorEqual(t, err, "invalid length for field 1")
+	})
+
+	t.Run("named event without a name", func(t *testing.T) {
+		_, _, err := newMessageReader(ContentTypeBinary, bytes.NewBuffer([]byte{1, binaryEventNamed})).ReadMessage()
+		assertErrorEqual(t, err, "frame has no event name")
+	})
+}
+
+func TestBinaryFraming_named_events(t *testing.T) {
+	t.Parallel()
+	buff := new(bytes.Buffer)
+	_, err := newMessageWriter(ContentTypeBinary, buff).WriteMessage(&NdJson{Event: "ping", Data: []byte{1}})
+	assertEqual(t, err, nil)
+	assertEqual(t, buff.Bytes(), []byte{10, binaryEventNamed, binaryFieldEvent, 4, 'p', 'i', 'n', 'g', binaryFieldData, 1, 1})
+	e, _, err := newMessageReader(ContentTypeBinary, buff).ReadMessage()
+	assertEqual(t, err, nil)
+	assertEqual(t, e, &NdJson{Event: "ping", Data: []byte{1}})
+}
+
+func TestBinaryFraming_optional_fields(t *testing.T) {
+	t.Parallel()
+	buff := new(bytes.Buffer)
+	_, err := newMessageWriter(ContentTypeBinary, buff).WriteMessage(&NdJson{Event: EventSync, Data: []byte{1}, KeyId: "k", Signature: []byte{2}, SignerId: "s"})
+	assertEqual(t, err, nil)
+	assertEqual(t, buff.Bytes(), []byte{13, binaryEventSync, binaryFieldKeyId, 1, 'k', binaryFieldSig, 1, 2, binaryFieldSigner, 1, 's', binaryFieldData, 1, 1})
+	e, _, err := newMessageReader(ContentTypeBinary, buff).ReadMessage()
+	assertEqual(t, err, nil)
+	assertEqual(t, e, &NdJson{Event: EventSync, Data: []byte{1}, KeyId: "k", Signature: []byte{2}, SignerId: "s"})
+}
+
+func TestNegotiateContentType(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		accept   string
+		expected string
+	}{
+		{"*/*", ContentType},
+		{"application/*", ContentType},
+		{ContentType, ContentType},
+		{ContentTypeWithCharset, ContentType},
+		{ContentTypeBinary, ContentTypeBinary},
+		{ContentType + ";q=0.5, " + ContentTypeBinary, ContentTypeBinary},
+		{ContentType + ", " + ContentTypeBinary + ";q=0.5", ContentType},
+		{"text/plain, " + ContentTypeBinary, ContentTypeBinary},
+		{"text/plain", ""},
+		{ContentType + "; charset=latin1", ""},
+	} {
+		t.Run(tc.accept, func(t *testing.T) {
+			actual, ok := negotiateContentType(tc.accept, ContentType)
+			assertEqual(t, actual, tc.expected)
+			assertEqual(t, ok, tc.expected != "")
+		})
+	}
+
+	t.Run("wildcard default", func(t *testing.T) {
+		actual, _ := negotiateContentType("*/*", ContentTypeBinary)
+		assertEqual(t, actual, ContentTypeBinary)
+	})
+}
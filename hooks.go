@@ -0,0 +1,172 @@
+package automergendjsonsync
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/automerge/automerge-go"
+)
+
+// SessionHooks are functions called at points in the lifecycle of a ServeChanges or HttpPushPullChanges session, such
+// as for audit logging or presence updates. Any of them may be nil. They are called synchronously from the sync, so
+// they must return quickly, and OnMessageReceived and OnMessageSent may be called concurrently with each other.
+type SessionHooks struct {
+	// OnConnect is called once the session has been accepted, before any message is exchanged. For clients this is
+	// when the request body starts being sent, which may be before the response and so before Session.PeerId is
+	// known.
+	OnConnect func(ctx context.Context, info ConnectInfo)
+	// OnMessageReceived is called after each sync message has been received into the sync state.
+	OnMessageReceived func(ctx context.Context, session SessionInfo, m *automerge.SyncMessage)
+	// OnMessageSent is called after each sync message has been written.
+	OnMessageSent func(ctx context.Context, session SessionInfo, m *automerge.SyncMessage)
+	// OnDisconnect is called when a session that was connected has finished, with the error that ServeChanges or
+	// HttpPushPullChanges returns. Its context is no longer cancelled with the session.
+	OnDisconnect func(ctx context.Context, result SyncResult, err error)
+}
+
+// ConnectInfo is passed to SessionHooks.OnConnect.
+type ConnectInfo struct {
+	// Session is the session that has connected. Session.PeerId is the identity of the peer, if known.
+	Session SessionInfo
+	// Request is the http request of the session, which for clients is the outgoing request.
+	Request *http.Request
+	// Heads are the heads of the local doc when the session connected.
+	Heads []automerge.ChangeHash
+}
+
+// SyncResult is passed to SessionHooks.OnDisconnect with a summary of the session.
+type SyncResult struct {
+	// Session is the final snapshot of the session, including the message and byte counts.
+	Session  SessionInfo
+	Duration time.Duration
+	// ReceivedChanges and SentChanges count the changes in the sync messages in each direction.
+	ReceivedChanges int
+	SentChanges     int
+	// StartHeads and EndHeads are the heads of the local doc when the session connected and disconnected.
+	StartHeads []automerge.ChangeHash
+	EndHeads   []automerge.ChangeHash
+	// RemoteHeads are the heads that the peer last advertised.
+	RemoteHeads []automerge.ChangeHash
+}
+
+// WithServerHooks calls the hooks for each session of ServeChanges.
+func WithServerHooks(hooks SessionHooks) ServerOption {
+	return func(o *serverOptions) {
+		o.hooks = &hooks
+	}
+}
+
+// WithClientHooks calls the hooks for the session of HttpPushPullChanges. When used with SyncWithPeers, the hooks are
+// called concurrently for each server.
+func WithClientHooks(hooks SessionHooks) ClientOption {
+	return func(o *clientOptions) {
+		o.hooks = &hooks
+	}
+}
+
+// hookRunner calls the hooks of a session and gathers the SyncResult. A nil runner does nothing.
+type hookRunner struct {
+	hooks      *SessionHooks
+	session    *liveSession
+	doc        *automerge.Doc
+	connected  bool
+	startHeads []automerge.ChangeHash
+
+	mutex           sync.Mutex
+	receivedChanges int
+	sentChanges     int
+}
+
+// newHookRunner returns a runner for the hooks, or nil if there are none.
+func newHookRunner(hooks *SessionHooks, session *liveSession, doc *automerge.Doc) *hookRunner {
+	if hooks == nil {
+		return nil
+	}
+	return &hookRunner{hooks: hooks, session: session, doc: doc}
+}
+
+// connect calls OnConnect. This must happen before the sync starts.
+func (h *hookRunner) connect(ctx context.Context, req *http.Request) {
+	if h == nil {
+		return
+	}
+	h.connected = true
+	h.startHeads = h.doc.Heads()
+	if h.hooks.OnConnect != nil {
+		h.hooks.OnConnect(ctx, ConnectInfo{Session: h.session.snapshot(), Request: req, Heads: slices.Clone(h.startHeads)})
+	}
+}
+
+// disconnect calls OnDisconnect if the session connected. This must happen after the sync has finished.
+func (h *hookRunner) disconnect(ctx context.Context, err error) {
+	if h == nil || !h.connected || h.hooks.OnDisconnect == nil {
+		return
+	}
+	info := h.session.snapshot()
+	h.session.mutex.Lock()
+	remoteHeads := slices.Clone(h.session.remoteHeads)
+	h.session.mutex.Unlock()
+	h.mutex.Lock()
+	result := SyncResult{
+		Session:         info,
+		Duration:        time.Since(info.StartedAt),
+		ReceivedChanges: h.receivedChanges,
+		SentChanges:     h.sentChanges,
+		StartHeads:      h.startHeads,
+		EndHeads:        h.doc.Heads(),
+		RemoteHeads:     remoteHeads,
+	}
+	h.mutex.Unlock()
+	h.hooks.OnDisconnect(ctx, result, err)
+}
+
+// terminationCheck wraps the termination check so that OnMessageReceived is called for each received message.
+func (h *hookRunner) terminationCheck(ctx context.Context, check TerminationCheck) TerminationCheck {
+	if h == nil {
+		return check
+	}
+	return func(doc *automerge.Doc, m *automerge.SyncMessage) bool {
+		h.mutex.Lock()
+		h.receivedChanges += len(m.Changes())
+		h.mutex.Unlock()
+		if h.hooks.OnMessageReceived != nil {
+			h.hooks.OnMessageReceived(ctx, h.session.snapshot(), m)
+		}
+		return check(doc, m)
+	}
+}
+
+type hookWriter struct {
+	ctx    context.Context
+	writer messageWriter
+	runner *hookRunner
+}
+
+func (w *hookWriter) WriteMessage(e *NdJson) (int, error) {
+	n, err := w.writer.WriteMessage(e)
+	if err != nil || e.sent == nil {
+		return n, err
+	}
+	w.runner.mutex.Lock()
+	w.runner.sentChanges += e.sent.changes
+	w.runner.mutex.Unlock()
+	if w.runner.hooks.OnMessageSent != nil {
+		w.runner.hooks.OnMessageSent(w.ctx, w.runner.session.snapshot(), e.sent.message)
+	}
+	return n, nil
+}
+
+func (w *hookWriter) Close() error {
+	return closeWriter(w.writer)
+}
+
+// writer wraps the writer so that OnMessageSent is called for each written sync message.
+func (h *hookRunner) writer(ctx context.Context, writer messageWriter) messageWriter {
+	if h == nil {
+		return writer
+	}
+	return &hookWriter{ctx: ctx, writer: writer, runner: h}
+}
@@ -0,0 +1,165 @@
+package automergendjsonsync
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/automerge/automerge-go"
+)
+
+// hookRecorder collects the calls of SessionHooks.
+type hookRecorder struct {
+	mutex   sync.Mutex
+	events  []string
+	connect ConnectInfo
+	result  SyncResult
+	err     error
+	// sentChanges counts the changes in the messages passed to OnMessageSent.
+	sentChanges int
+}
+
+func (r *hookRecorder) record(event string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events = append(r.events, event)
+}
+
+func (r *hookRecorder) hooks() SessionHooks {
+	return SessionHooks{
+		OnConnect: func(ctx context.Context, info ConnectInfo) {
+			r.record("connect")
+			r.connect = info
+		},
+		OnMessageReceived: func(ctx context.Context, session SessionInfo, m *automerge.SyncMessage) {
+			r.record("received")
+		},
+		OnMessageSent: func(ctx context.Context, session SessionInfo, m *automerge.SyncMessage) {
+			r.record("sent")
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			r.sentChanges += len(m.Changes())
+		},
+		OnDisconnect: func(ctx context.Context, result SyncResult, err error) {
+			r.record("disconnect")
+			r.result, r.err = result, err
+		},
+	}
+}
+
+// assertLifecycle checks that the session connected first, exchanged messages and disconnected last.
+func (r *hookRecorder) assertLifecycle(t *testing.T) {
+	t.Helper()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if assertEqual(t, len(r.events) > 2, true) {
+		assertEqual(t, r.events[0], "connect")
+		assertEqual(t, r.events[len(r.events)-1], "disconnect")
+		assertEqual(t, slices.Contains(r.events, "received"), true)
+		assertEqual(t, slices.Contains(r.events, "sent"), true)
+	}
+}
+
+func TestSessionHooks(t *testing.T) {
+	t.Parallel()
+
+	t.Run("http", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		serverDoc := NewSharedDoc(automerge.New())
+		assertEqual(t, serverDoc.Doc().RootMap().Set("a", "b"), nil)
+		_, _ = serverDoc.Doc().Commit("change")
+		serverStart := serverDoc.Doc().Heads()
+		serverHooks := new(hookRecorder)
+		serveErrs := make(chan error, 1)
+		url := startTestServer(t, &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			serveErrs <- serverDoc.ServeChanges(w, r, WithServerHooks(serverHooks.hooks()), WithServerIdentity(func(req *http.Request) (string, error) {
+				return "alice", nil
+			}))
+		})})
+
+		clientDoc := NewSharedDoc(automerge.New())
+		assertEqual(t, clientDoc.Doc().RootMap().Set("c", "d"), nil)
+		_, _ = clientDoc.Doc().Commit("change")
+		clientStart := clientDoc.Doc().Heads()
+		clientHooks := new(hookRecorder)
+		assertEqual(t, clientDoc.HttpPushPullChanges(ctx, url, WithClientTerminationCheck(HeadsEqualCheck), WithClientHooks(clientHooks.hooks())), nil)
+		assertEqual(t, <-serveErrs, nil)
+
+		serverHooks.assertLifecycle(t)
+		assertEqual(t, serverHooks.connect.Session.Role, SessionServer)
+		assertEqual(t, serverHooks.connect.Session.PeerId, "alice")
+		assertEqual(t, serverHooks.connect.Request.Method, http.MethodPut)
+		assertEqual(t, serverHooks.connect.Heads, serverStart)
+		assertEqual(t, serverHooks.result.Session.Id, serverHooks.connect.Session.Id)
+		assertEqual(t, serverHooks.result.StartHeads, serverStart)
+		assertEqual(t, serverHooks.result.ReceivedChanges >= 1, true)
+		assertEqual(t, serverHooks.result.SentChanges >= 1, true)
+		assertEqual(t, serverHooks.err, nil)
+
+		clientHooks.assertLifecycle(t)
+		assertEqual(t, clientHooks.connect.Session.Role, SessionClient)
+		assertEqual(t, clientHooks.connect.Request.URL.String(), url)
+		assertEqual(t, clientHooks.connect.Heads, clientStart)
+		assertEqual(t, clientHooks.result.StartHeads, clientStart)
+		assertEqual(t, clientHooks.result.EndHeads, serverDoc.Doc().Heads())
+		assertEqual(t, historyHasHeads(clientDoc.Doc(), clientHooks.result.RemoteHeads, serverDoc.Doc().Heads()), true)
+		assertEqual(t, clientHooks.result.ReceivedChanges >= 1, true)
+		assertEqual(t, clientHooks.result.SentChanges >= 1, true)
+		assertEqual(t, clientHooks.result.Session.ReceivedMessages > 0, true)
+		assertEqual(t, clientHooks.err, nil)
+	})
+
+	t.Run("pull only", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		serverDoc := NewSharedDoc(automerge.New())
+		assertEqual(t, serverDoc.Doc().RootMap().Set("a", "b"), nil)
+		_, _ = serverDoc.Doc().Commit("change")
+		serveErrs := make(chan error, 1)
+		url := startTestServer(t, &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			serveErrs <- serverDoc.ServeChanges(w, r)
+		})})
+
+		clientDoc := NewSharedDoc(automerge.New())
+		assertEqual(t, clientDoc.Doc().RootMap().Set("c", "d"), nil)
+		_, _ = clientDoc.Doc().Commit("change")
+		clientHooks := new(hookRecorder)
+		assertEqual(t, clientDoc.HttpPushPullChanges(ctx, url, WithClientPullOnly(), WithClientHooks(clientHooks.hooks())), nil)
+		assertEqual(t, <-serveErrs, nil)
+
+		// the hooks see the messages as they were sent, without the local changes
+		clientHooks.assertLifecycle(t)
+		assertEqual(t, clientHooks.sentChanges, 0)
+		assertEqual(t, clientHooks.result.SentChanges, 0)
+		assertEqual(t, clientHooks.result.ReceivedChanges >= 1, true)
+	})
+
+	t.Run("rejected request is not a session", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		serverDoc := NewSharedDoc(automerge.New())
+		serverHooks := new(hookRecorder)
+		serveErrs := make(chan error, 1)
+		url := startTestServer(t, &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			serveErrs <- serverDoc.ServeChanges(w, r, WithServerHooks(serverHooks.hooks()), WithServerIdentity(func(req *http.Request) (string, error) {
+				return "", fmt.Errorf("no identity")
+			}))
+		})})
+
+		err := NewSharedDoc(automerge.New()).HttpPushPullChanges(ctx, url)
+		assertErrorEqual(t, err, "http request failed with status 403")
+		assertEqual(t, <-serveErrs, nil)
+		assertEqual(t, len(serverHooks.events), 0)
+	})
+}
@@ -0,0 +1,87 @@
+package automergendjsonsync
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/automerge/automerge-go"
+)
+
+type identityContextKeyType int
+
+var identityContextKey = identityContextKeyType(0)
+
+// SetContextIdentity returns a context carrying the authenticated identity of the peer. ServeChanges does this when
+// WithServerIdentity is used, so that line read predicates can make decisions based on the identity.
+func SetContextIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, identityContextKey, identity)
+}
+
+// ContextIdentity returns the identity set by SetContextIdentity, if any.
+func ContextIdentity(ctx context.Context) (string, bool) {
+	v, ok := ctx.Value(identityContextKey).(string)
+	return v, ok
+}
+
+// An IdentityExtractor returns the authenticated identity of the peer that made the request. An error causes the
+// request to be rejected with a 403 Forbidden.
+type IdentityExtractor func(req *http.Request) (string, error)
+
+// CertificateCommonNameIdentity is an IdentityExtractor which uses the common name of the client certificate from
+// mutual TLS. The http server must be configured to verify client certificates, for example with
+// tls.RequireAndVerifyClientCert, otherwise the certificate proves nothing.
+func CertificateCommonNameIdentity(req *http.Request) (string, error) {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return "", fmt.Errorf("no client certificate")
+	} else if cn := req.TLS.PeerCertificates[0].Subject.CommonName; cn != "" {
+		return cn, nil
+	}
+	return "", fmt.Errorf("client certificate has no common name")
+}
+
+var _ IdentityExtractor = CertificateCommonNameIdentity
+
+// WithServerIdentity extracts the identity of the peer from each request and sets it on the context with
+// SetContextIdentity. Requests are rejected with a 403 Forbidden if the identity can't be extracted.
+func WithServerIdentity(f IdentityExtractor) ServerOption {
+	return func(o *serverOptions) {
+		o.identityExtractor = f
+	}
+}
+
+// An ActorPolicy returns whether the peer with the given identity may send changes made by the given actor.
+type ActorPolicy func(identity string, actorId string) bool
+
+// StaticActorPolicy is an ActorPolicy which permits each identity to send changes from the listed actor ids only.
+func StaticActorPolicy(actors map[string][]string) ActorPolicy {
+	return func(identity string, actorId string) bool {
+		return slices.Contains(actors[identity], actorId)
+	}
+}
+
+// ActorPolicyReadPredicate returns a LineReadPredicate which aborts the sync if a message contains a new change from
+// an actor that the identity on the context is not permitted to send, so that one peer can't forge another's edits.
+// Changes that are already in the doc are not checked, since the peer may have received them from someone else. Use
+// this with WithServerIdentity.
+func ActorPolicyReadPredicate(policy ActorPolicy) LineReadPredicate {
+	return func(ctx context.Context, line *NdJson, doc *automerge.Doc, msg *automerge.SyncMessage) (bool, error) {
+		changes := msg.Changes()
+		if len(changes) == 0 {
+			return true, nil
+		}
+		identity, ok := ContextIdentity(ctx)
+		if !ok {
+			return false, fmt.Errorf("no identity to check changes against")
+		}
+		for _, change := range changes {
+			if _, err := doc.Change(change.Hash()); err == nil {
+				continue
+			} else if !policy(identity, change.ActorID()) {
+				return false, fmt.Errorf("identity '%s' is not permitted to send changes from actor '%s'", identity, change.ActorID())
+			}
+		}
+		return true, nil
+	}
+}
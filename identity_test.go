@@ -0,0 +1,85 @@
+package automergendjsonsync
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/automerge/automerge-go"
+)
+
+// changeRequestBody returns a request body with a single sync message carrying the changes of the doc.
+func changeRequestBody(t *testing.T, doc *automerge.Doc) *strings.Reader {
+	t.Helper()
+	state := automerge.NewSyncState(doc)
+	m, _ := automerge.NewSyncState(automerge.New()).GenerateMessage()
+	_, err := state.ReceiveMessage(m.Bytes())
+	assertEqual(t, err, nil)
+	m, _ = state.GenerateMessage()
+	assertEqual(t, len(m.Changes()), 1)
+	raw, _ := json.Marshal(&NdJson{Event: EventSync, Data: m.Bytes()})
+	return strings.NewReader(string(raw) + "\n")
+}
+
+func TestActorPolicy(t *testing.T) {
+	t.Parallel()
+	clientDoc := automerge.New()
+	assertEqual(t, clientDoc.RootMap().Set("a", "b"), nil)
+	_, _ = clientDoc.Commit("change")
+	policy := StaticActorPolicy(map[string][]string{"alice": {clientDoc.ActorID()}, "bob": {"other"}})
+
+	newRequest := func(ctx context.Context, commonName string) *http.Request {
+		req := httptest.NewRequestWithContext(ctx, http.MethodPut, "https://localhost/", changeRequestBody(t, clientDoc))
+		if commonName != "" {
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: commonName}}}}
+		}
+		return req
+	}
+	opts := []ServerOption{WithServerIdentity(CertificateCommonNameIdentity), WithLineReadPredicate(ActorPolicyReadPredicate(policy))}
+
+	t.Run("no certificate", func(t *testing.T) {
+		sd := NewSharedDoc(automerge.New())
+		rw := httptest.NewRecorder()
+		assertEqual(t, sd.ServeChanges(rw, newRequest(context.Background(), ""), opts...), nil)
+		assertEqual(t, rw.Result().StatusCode, http.StatusForbidden)
+	})
+
+	// serveUntilReceived serves the request until the first message has been received
+	serveUntilReceived := func(sd *SharedDoc, commonName string) error {
+		sub, fin := sd.SubscribeToReceivedChanges()
+		defer fin()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			<-sub
+			cancel()
+		}()
+		return sd.ServeChanges(httptest.NewRecorder(), newRequest(ctx, commonName), opts...)
+	}
+
+	t.Run("permitted actor", func(t *testing.T) {
+		sd := NewSharedDoc(automerge.New())
+		assertEqual(t, serveUntilReceived(sd, "alice"), nil)
+		assertEqual(t, sd.Doc().Heads(), clientDoc.Heads())
+	})
+
+	t.Run("forbidden actor", func(t *testing.T) {
+		sd := NewSharedDoc(automerge.New())
+		rw := httptest.NewRecorder()
+		err := sd.ServeChanges(rw, newRequest(context.Background(), "bob"), opts...)
+		assertErrorEqual(t, err, "failed to run read predicate on message 1: identity 'bob' is not permitted to send changes from actor '"+clientDoc.ActorID()+"'")
+		assertEqual(t, len(sd.Doc().Heads()), 0)
+	})
+
+	t.Run("changes already in the doc", func(t *testing.T) {
+		fork, err := clientDoc.Fork()
+		assertEqual(t, err, nil)
+		assertEqual(t, serveUntilReceived(NewSharedDoc(fork), "bob"), nil)
+	})
+}
@@ -0,0 +1,98 @@
+package automergendjsonsync
+
+import (
+	"fmt"
+
+	"github.com/automerge/automerge-go"
+)
+
+// clientMode is the direction that HttpPushPullChanges syncs changes in.
+type clientMode int
+
+const (
+	clientPushPull clientMode = iota
+	clientPullOnly
+	clientPushOnly
+)
+
+// WithClientPullOnly only pulls changes from the server, such as for a backup job. Local changes are dropped from the
+// messages sent to the server, and HttpPushPullChanges returns once the local doc has all the remote heads. This
+// replaces any WithClientTerminationCheck, and the last of WithClientPullOnly and WithClientPushOnly wins.
+func WithClientPullOnly() ClientOption {
+	return func(o *clientOptions) {
+		o.mode = clientPullOnly
+	}
+}
+
+// WithClientPushOnly only pushes changes to the server, such as for a telemetry emitter. Changes are dropped from the
+// messages received from the server, so the local doc is never modified, and HttpPushPullChanges returns once the
+// server has all the local heads. This replaces any WithClientTerminationCheck, and the last of WithClientPullOnly and
+// WithClientPushOnly wins.
+func WithClientPushOnly() ClientOption {
+	return func(o *clientOptions) {
+		o.mode = clientPushOnly
+	}
+}
+
+// remoteHasSyncedLocalHeads is a TerminationCheck like RemoteHasAllLocalHeads which also counts the heads that the
+// remote last synced with us. This is met once the remote has the local heads even if it has made other changes that
+// we haven't received, which is always the case for a push-only client.
+func remoteHasSyncedLocalHeads(doc *automerge.Doc, m *automerge.SyncMessage) bool {
+	remoteHeads := m.Heads()
+	if _, have, _, err := parseSyncMessageNeedHave(m.Bytes()); err == nil {
+		for _, h := range have {
+			remoteHeads = append(remoteHeads, h.lastSync...)
+		}
+	}
+	_, missingInRemote := CompareHeads(doc.Heads(), remoteHeads)
+	return missingInRemote == 0
+}
+
+var _ TerminationCheck = remoteHasSyncedLocalHeads
+
+// stripSyncMessageChanges returns a copy of the encoded sync message with an empty list of changes. The peer still
+// learns our heads and what we need, but receives none of our changes.
+func stripSyncMessageChanges(raw []byte) ([]byte, error) {
+	_, _, changesAt, err := parseSyncMessageNeedHave(raw)
+	if err != nil {
+		return nil, err
+	}
+	return append(raw[:changesAt:changesAt], 0), nil
+}
+
+type stripChangesWriter struct {
+	writer messageWriter
+}
+
+func (w *stripChangesWriter) WriteMessage(e *NdJson) (int, error) {
+	if e.Event != EventSync {
+		return w.writer.WriteMessage(e)
+	}
+	data, err := stripSyncMessageChanges(e.Data)
+	if err != nil {
+		return 0, fmt.Errorf("failed to strip changes: %w", err)
+	}
+	out := *e
+	out.Data = data
+	if e.sent != nil {
+		// Without the changes, the message is small enough that loading it again is cheap.
+		m, err := automerge.LoadSyncMessage(data)
+		if err != nil {
+			return 0, fmt.Errorf("failed to strip changes: %w", err)
+		}
+		out.sent = &sentSyncMessage{message: m, raw: data, need: e.sent.need}
+	}
+	return w.writer.WriteMessage(&out)
+}
+
+func (w *stripChangesWriter) Close() error {
+	return closeWriter(w.writer)
+}
+
+// stripWriter wraps the writer so that the changes are dropped from each sync message, if strip is set.
+func stripWriter(strip bool, writer messageWriter) messageWriter {
+	if !strip {
+		return writer
+	}
+	return &stripChangesWriter{writer: writer}
+}
@@ -0,0 +1,117 @@
+package automergendjsonsync
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/automerge/automerge-go"
+)
+
+func TestClientModes(t *testing.T) {
+	t.Parallel()
+
+	setup := func(t *testing.T) (*SharedDoc, *SharedDoc, string) {
+		serverDoc := NewSharedDoc(automerge.New())
+		assertEqual(t, serverDoc.Doc().RootMap().Set("server", "a"), nil)
+		_, _ = serverDoc.Doc().Commit("change")
+		url := startTestServer(t, &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_ = serverDoc.ServeChanges(w, r)
+		})})
+		clientDoc := NewSharedDoc(automerge.New())
+		assertEqual(t, clientDoc.Doc().RootMap().Set("client", "b"), nil)
+		_, _ = clientDoc.Doc().Commit("change")
+		return serverDoc, clientDoc, url
+	}
+
+	t.Run("pull only", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+		serverDoc, clientDoc, url := setup(t)
+		serverHeads := serverDoc.Doc().Heads()
+
+		assertEqual(t, clientDoc.HttpPushPullChanges(ctx, url, WithClientPullOnly()), nil)
+		missingInClient, _ := CompareHeads(clientDoc.Doc().Heads(), serverHeads)
+		assertEqual(t, missingInClient, 0)
+		assertEqual(t, serverDoc.Doc().Heads(), serverHeads)
+	})
+
+	t.Run("push only", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+		serverDoc, clientDoc, url := setup(t)
+		clientHeads := clientDoc.Doc().Heads()
+
+		assertEqual(t, clientDoc.HttpPushPullChanges(ctx, url, WithClientPushOnly()), nil)
+		missingInServer, _ := CompareHeads(serverDoc.Doc().Heads(), clientHeads)
+		assertEqual(t, missingInServer, 0)
+		assertEqual(t, clientDoc.Doc().Heads(), clientHeads)
+	})
+
+	t.Run("push only when the first response carries changes", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+		serverDoc, clientDoc, _ := setup(t)
+		clientHeads := clientDoc.Doc().Heads()
+
+		// the server receives the first message of the client before writing its own, so that it carries changes
+		serveErrs := make(chan error, 1)
+		assertEqual(t, clientDoc.HttpPushPullChanges(ctx, "https://localhost", WithClientPushOnly(), WithHttpClient(HttpDoerFunc(func(request *http.Request) (*http.Response, error) {
+			reader := bufio.NewReader(request.Body)
+			line, err := reader.ReadBytes('\n')
+			assertEqual(t, err, nil)
+			var e NdJson
+			assertEqual(t, json.Unmarshal(line, &e), nil)
+			state := automerge.NewSyncState(serverDoc.Doc())
+			_, err = state.ReceiveMessage(e.Data)
+			assertEqual(t, err, nil)
+			body, writer := io.Pipe()
+			go func() {
+				err := serverDoc.SyncOverStream(ctx, reader, writer, WithStreamSyncState(state))
+				_ = writer.CloseWithError(err)
+				serveErrs <- err
+			}()
+			return &http.Response{StatusCode: http.StatusOK, Body: body}, nil
+		}))), nil)
+		assertEqual(t, <-serveErrs, nil)
+		missingInServer, _ := CompareHeads(serverDoc.Doc().Heads(), clientHeads)
+		assertEqual(t, missingInServer, 0)
+		assertEqual(t, clientDoc.Doc().Heads(), clientHeads)
+	})
+
+	t.Run("push only with nothing to push", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+		_, _, url := setup(t)
+		clientDoc := NewSharedDoc(automerge.New())
+
+		assertEqual(t, clientDoc.HttpPushPullChanges(ctx, url, WithClientPushOnly()), nil)
+		assertEqual(t, len(clientDoc.Doc().Heads()), 0)
+	})
+}
+
+func TestStripSyncMessageChanges(t *testing.T) {
+	t.Parallel()
+	doc := automerge.New()
+	m := changeMessage(t, doc, func(doc *automerge.Doc) {
+		assertEqual(t, doc.RootMap().Set("a", "b"), nil)
+	})
+
+	raw, err := stripSyncMessageChanges(m.Bytes())
+	assertEqual(t, err, nil)
+	stripped, err := automerge.LoadSyncMessage(raw)
+	assertEqual(t, err, nil)
+	assertEqual(t, len(stripped.Changes()), 0)
+	assertEqual(t, stripped.Heads(), m.Heads())
+
+	_, err = stripSyncMessageChanges([]byte("{}"))
+	assertErrorEqual(t, err, "not a sync message")
+}
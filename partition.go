@@ -0,0 +1,92 @@
+package automergendjsonsync
+
+import (
+	"hash/crc32"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// HashRing is a consistent-hash ring that assigns each document id to one of a set of cluster members. Each member is
+// placed on the ring multiple times so that documents spread evenly, and when the members change only the documents
+// near the changed members move. It is safe to change the members while the ring is in use.
+type HashRing struct {
+	mutex    sync.RWMutex
+	replicas int
+	members  []string
+	points   []uint32
+	owners   map[uint32]string
+}
+
+// NewHashRing returns a HashRing that places each member on the ring the given number of times.
+func NewHashRing(replicas int, members ...string) *HashRing {
+	h := &HashRing{replicas: max(replicas, 1)}
+	h.SetMembers(members...)
+	return h
+}
+
+// SetMembers replaces the members of the ring.
+func (h *HashRing) SetMembers(members ...string) {
+	members = slices.Compact(slices.Sorted(slices.Values(members)))
+	points := make([]uint32, 0, len(members)*h.replicas)
+	owners := make(map[uint32]string, len(members)*h.replicas)
+	for _, member := range members {
+		for i := 0; i < h.replicas; i++ {
+			point := crc32.ChecksumIEEE([]byte(member + "#" + strconv.Itoa(i)))
+			// On the rare collision, the lowest member wins so that every instance of the ring agrees.
+			if _, ok := owners[point]; !ok {
+				owners[point] = member
+				points = append(points, point)
+			}
+		}
+	}
+	slices.Sort(points)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.members, h.points, h.owners = members, points, owners
+}
+
+// Members returns the sorted members of the ring.
+func (h *HashRing) Members() []string {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return slices.Clone(h.members)
+}
+
+// Owner returns the member that owns the given key. This returns false if the ring has no members.
+func (h *HashRing) Owner(key string) (string, bool) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	if len(h.points) == 0 {
+		return "", false
+	}
+	point := crc32.ChecksumIEEE([]byte(key))
+	i, _ := slices.BinarySearch(h.points, point)
+	if i == len(h.points) {
+		i = 0
+	}
+	return h.owners[h.points[i]], true
+}
+
+// PartitionHandler wraps the given handler so that PUT requests for documents that are not owned by this member of
+// the ring are answered with a 307 redirect to the owner. Members are base urls such as "https://node-1:8080" and the
+// redirect keeps the path and query of the original request. The docId function extracts the document id from the
+// request, for example through http.Request.PathValue. Changing the members of the ring takes effect immediately.
+func PartitionHandler(self string, ring *HashRing, docId func(r *http.Request) string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			if owner, ok := ring.Owner(docId(r)); ok && owner != self {
+				location := strings.TrimSuffix(owner, "/") + r.URL.RequestURI()
+				Logger(r.Context()).InfoContext(r.Context(), "redirecting to partition owner", slog.String("owner", owner), slog.String("location", location))
+				w.Header().Set("Location", location)
+				w.WriteHeader(http.StatusTemporaryRedirect)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,102 @@
+package automergendjsonsync
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/automerge/automerge-go"
+)
+
+func TestHashRing(t *testing.T) {
+	t.Parallel()
+
+	t.Run("empty", func(t *testing.T) {
+		_, ok := NewHashRing(10).Owner("a")
+		assertEqual(t, ok, false)
+	})
+
+	t.Run("membership changes only move some keys", func(t *testing.T) {
+		ring := NewHashRing(50, "c", "a", "b", "a")
+		assertEqual(t, ring.Members(), []string{"a", "b", "c"})
+		before := make(map[string]string)
+		counts := make(map[string]int)
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprintf("doc-%d", i)
+			before[key], _ = ring.Owner(key)
+			counts[before[key]]++
+		}
+		// every member should own a reasonable share of the keys
+		for _, member := range ring.Members() {
+			assertEqual(t, counts[member] > 150, true)
+		}
+
+		ring.SetMembers("a", "b")
+		for key, owner := range before {
+			after, _ := ring.Owner(key)
+			if owner != "c" {
+				assertEqual(t, after, owner)
+			} else {
+				assertEqual(t, after != "c", true)
+			}
+		}
+	})
+}
+
+func TestPartitionHandler(t *testing.T) {
+	t.Parallel()
+
+	ring := NewHashRing(10)
+	repos := make(map[string]*Repo)
+	urls := make([]string, 0)
+	for i := 0; i < 2; i++ {
+		repo := NewRepo()
+		mux := http.NewServeMux()
+		server := &http.Server{Handler: mux}
+		url := startTestServer(t, server)
+		mux.Handle("/{id}", PartitionHandler(url, ring, func(r *http.Request) string {
+			return r.PathValue("id")
+		}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_ = repo.GetOrCreate(r.PathValue("id")).ServeChanges(w, r)
+		})))
+		repos[url] = repo
+		urls = append(urls, url)
+	}
+	// Membership is set after the servers have started, since it can change at any time.
+	ring.SetMembers(urls...)
+
+	for i := 0; i < 4; i++ {
+		id := fmt.Sprintf("doc-%d", i)
+		owner, _ := ring.Owner(id)
+		peerDoc := NewSharedDoc(automerge.New())
+		assertEqual(t, peerDoc.Doc().RootMap().Set("a", "b"), nil)
+		_, _ = peerDoc.Doc().Commit("change")
+		// Always connect to the first server and let it redirect us if required.
+		assertEqual(t, peerDoc.HttpPushPullChanges(context.Background(), urls[0]+"/"+id, WithClientTerminationCheck(HeadsEqualCheck)), nil)
+		_, ok := repos[owner].Get(id)
+		assertEqual(t, ok, true)
+		for url, repo := range repos {
+			if url != owner {
+				_, ok := repo.Get(id)
+				assertEqual(t, ok, false)
+			}
+		}
+	}
+
+	t.Run("non put requests are not redirected", func(t *testing.T) {
+		h := PartitionHandler("self", NewHashRing(1, "other"), func(r *http.Request) string {
+			return "x"
+		}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/x?y=z", nil))
+		assertEqual(t, rw.Code, http.StatusNoContent)
+		rw = httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodPut, "/x?y=z", nil))
+		assertEqual(t, rw.Code, http.StatusTemporaryRedirect)
+		assertEqual(t, rw.Header().Get("Location"), "other/x?y=z")
+	})
+}
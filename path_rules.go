@@ -0,0 +1,146 @@
+package automergendjsonsync
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/automerge/automerge-go"
+)
+
+// PathRule restricts who may write to the paths of a doc that match a pattern.
+type PathRule struct {
+	// Pattern is a "/" separated list of map keys and list indexes from the root of the doc. Each segment may be a glob
+	// as supported by path.Match, and a final "**" segment matches any number of remaining segments, including none.
+	Pattern string
+	// Identities are the identities permitted to write to matching paths. The identity "*" permits anyone.
+	Identities []string
+}
+
+func (r PathRule) matches(segments []string) bool {
+	patterns := strings.Split(r.Pattern, "/")
+	for i, pattern := range patterns {
+		if pattern == "**" && i == len(patterns)-1 {
+			return true
+		} else if i >= len(segments) {
+			return false
+		} else if ok, _ := path.Match(pattern, segments[i]); !ok {
+			return false
+		}
+	}
+	return len(segments) == len(patterns)
+}
+
+// PathRulesReadPredicate returns a LineReadPredicate which aborts the sync if a message modifies a path that the
+// identity on the context is not permitted to write. Each message with changes is applied to a fork of the doc and
+// the values before and after are compared to find the paths it touches. Replacing or deleting a value touches every
+// path beneath it too. The first rule that matches a touched path decides whether it may be written, and paths that
+// match no rule may be written by anyone, so add a final "**" rule to deny by default. The identity is empty if
+// there is none on the context, see WithServerIdentity.
+//
+// Since this compares the visible values of the doc, a change which doesn't alter any value is allowed. Comparing
+// the whole doc has a cost proportional to the size of the doc for every message with changes.
+func PathRulesReadPredicate(rules ...PathRule) (LineReadPredicate, error) {
+	for _, rule := range rules {
+		for _, segment := range strings.Split(rule.Pattern, "/") {
+			if _, err := path.Match(segment, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern '%s': %w", rule.Pattern, err)
+			}
+		}
+	}
+	return func(ctx context.Context, line *NdJson, doc *automerge.Doc, msg *automerge.SyncMessage) (bool, error) {
+		changes := msg.Changes()
+		if len(changes) == 0 {
+			return true, nil
+		}
+		fork, err := doc.Fork()
+		if err != nil {
+			return false, fmt.Errorf("failed to fork doc: %w", err)
+		}
+		before := fork.Root().Interface()
+		if err := fork.Apply(changes...); err != nil {
+			return false, fmt.Errorf("failed to apply changes to fork: %w", err)
+		}
+		identity, _ := ContextIdentity(ctx)
+		var denied []string
+		diffPaths(nil, before, fork.Root().Interface(), func(segments []string) {
+			for _, rule := range rules {
+				if rule.matches(segments) {
+					if !slices.Contains(rule.Identities, identity) && !slices.Contains(rule.Identities, "*") {
+						denied = append(denied, strings.Join(segments, "/"))
+					}
+					return
+				}
+			}
+		})
+		if len(denied) > 0 {
+			return false, fmt.Errorf("identity '%s' is not permitted to write path '%s'", identity, denied[0])
+		}
+		return true, nil
+	}, nil
+}
+
+// diffPaths calls visit with the path of every value that differs between a and b.
+func diffPaths(segments []string, a, b any, visit func(segments []string)) {
+	switch av := a.(type) {
+	case map[string]any:
+		if bv, ok := b.(map[string]any); ok {
+			keys := make([]string, 0, len(av)+len(bv))
+			for k := range av {
+				keys = append(keys, k)
+			}
+			for k := range bv {
+				if _, ok := av[k]; !ok {
+					keys = append(keys, k)
+				}
+			}
+			slices.Sort(keys)
+			for _, k := range keys {
+				diffPaths(append(slices.Clip(segments), k), av[k], bv[k], visit)
+			}
+			return
+		}
+	case []any:
+		if bv, ok := b.([]any); ok {
+			for i := 0; i < max(len(av), len(bv)); i++ {
+				var ai, bi any
+				if i < len(av) {
+					ai = av[i]
+				}
+				if i < len(bv) {
+					bi = bv[i]
+				}
+				diffPaths(append(slices.Clip(segments), strconv.Itoa(i)), ai, bi, visit)
+			}
+			return
+		}
+	}
+	if !reflect.DeepEqual(a, b) {
+		visit(segments)
+		// The values beneath a replaced or deleted value are touched too.
+		walkPaths(segments, a, visit)
+		walkPaths(segments, b, visit)
+	}
+}
+
+// walkPaths calls visit with the path of every value beneath v.
+func walkPaths(segments []string, v any, visit func(segments []string)) {
+	switch vv := v.(type) {
+	case map[string]any:
+		for k, child := range vv {
+			childSegments := append(slices.Clip(segments), k)
+			visit(childSegments)
+			walkPaths(childSegments, child, visit)
+		}
+	case []any:
+		for i, child := range vv {
+			childSegments := append(slices.Clip(segments), strconv.Itoa(i))
+			visit(childSegments)
+			walkPaths(childSegments, child, visit)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package automergendjsonsync
+
+import (
+	"context"
+	"testing"
+
+	"github.com/automerge/automerge-go"
+)
+
+// changeMessage returns a sync message from a fork of the doc carrying the changes made by the edit.
+func changeMessage(t *testing.T, doc *automerge.Doc, edit func(doc *automerge.Doc)) *automerge.SyncMessage {
+	t.Helper()
+	fork, err := doc.Fork()
+	assertEqual(t, err, nil)
+	edit(fork)
+	_, _ = fork.Commit("change")
+	// exchange messages until the fork sends its changes
+	docState, forkState := automerge.NewSyncState(doc), automerge.NewSyncState(fork)
+	for i := 0; i < 5; i++ {
+		if m, ok := docState.GenerateMessage(); ok {
+			_, err = forkState.ReceiveMessage(m.Bytes())
+			assertEqual(t, err, nil)
+		}
+		if m, ok := forkState.GenerateMessage(); ok && len(m.Changes()) > 0 {
+			return m
+		} else if ok {
+			_, err = docState.ReceiveMessage(m.Bytes())
+			assertEqual(t, err, nil)
+		}
+	}
+	t.Fatal("expected a message with changes")
+	return nil
+}
+
+func TestPathRulesReadPredicate(t *testing.T) {
+	t.Parallel()
+	doc := automerge.New()
+	assertEqual(t, doc.RootMap().Set("title", "hello"), nil)
+	assertEqual(t, doc.RootMap().Set("owner", "alice"), nil)
+	assertEqual(t, doc.RootMap().Set("permissions", map[string]any{"bob": "read"}), nil)
+	assertEqual(t, doc.RootMap().Set("settings", map[string]any{"owner": "alice", "theme": "dark"}), nil)
+	_, _ = doc.Commit("initial")
+
+	predicate, err := PathRulesReadPredicate(
+		PathRule{Pattern: "owner", Identities: []string{"admin"}},
+		PathRule{Pattern: "permissions/**", Identities: []string{"admin"}},
+		PathRule{Pattern: "*/owner", Identities: []string{"admin"}},
+	)
+	assertEqual(t, err, nil)
+
+	for _, tc := range []struct {
+		name     string
+		identity string
+		edit     func(doc *automerge.Doc)
+		err      string
+	}{
+		{name: "unprotected", identity: "bob", edit: func(doc *automerge.Doc) {
+			_ = doc.RootMap().Set("title", "bye")
+		}},
+		{name: "protected key", identity: "bob", edit: func(doc *automerge.Doc) {
+			_ = doc.RootMap().Set("owner", "bob")
+		}, err: "identity 'bob' is not permitted to write path 'owner'"},
+		{name: "protected key by admin", identity: "admin", edit: func(doc *automerge.Doc) {
+			_ = doc.RootMap().Set("owner", "bob")
+		}},
+		{name: "nested key", identity: "bob", edit: func(doc *automerge.Doc) {
+			_ = doc.Path("permissions", "bob").Set("write")
+		}, err: "identity 'bob' is not permitted to write path 'permissions/bob'"},
+		{name: "deleted subtree", identity: "bob", edit: func(doc *automerge.Doc) {
+			_ = doc.RootMap().Delete("permissions")
+		}, err: "identity 'bob' is not permitted to write path 'permissions'"},
+		{name: "deleted parent of protected key", identity: "bob", edit: func(doc *automerge.Doc) {
+			_ = doc.RootMap().Delete("settings")
+		}, err: "identity 'bob' is not permitted to write path 'settings/owner'"},
+		{name: "no identity", edit: func(doc *automerge.Doc) {
+			_ = doc.RootMap().Set("owner", "bob")
+		}, err: "identity '' is not permitted to write path 'owner'"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tc.identity != "" {
+				ctx = SetContextIdentity(ctx, tc.identity)
+			}
+			ok, err := predicate(ctx, &NdJson{Event: EventSync}, doc, changeMessage(t, doc, tc.edit))
+			if tc.err != "" {
+				assertErrorEqual(t, err, tc.err)
+				assertEqual(t, ok, false)
+			} else {
+				assertEqual(t, err, nil)
+				assertEqual(t, ok, true)
+			}
+		})
+	}
+	// the predicate must not modify the doc
+	assertEqual(t, doc.RootMap().Len(), 4)
+}
+
+func TestPathRule_matches(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		pattern string
+		path    []string
+		matches bool
+	}{
+		{"owner", []string{"owner"}, true},
+		{"owner", []string{"owner", "name"}, false},
+		{"owner", []string{}, false},
+		{"*/owner", []string{"settings", "owner"}, true},
+		{"items/*/owner", []string{"items", "0", "owner"}, true},
+		{"permissions/**", []string{"permissions"}, true},
+		{"permissions/**", []string{"permissions", "a", "b"}, true},
+		{"permissions/**", []string{"other"}, false},
+		{"**", []string{"anything", "at", "all"}, true},
+		{"perm*", []string{"permissions"}, true},
+	} {
+		assertEqual(t, PathRule{Pattern: tc.pattern}.matches(tc.path), tc.matches)
+	}
+	_, err := PathRulesReadPredicate(PathRule{Pattern: "a/[b"})
+	assertErrorEqual(t, err, "invalid pattern 'a/[b': syntax error in pattern")
+}
@@ -0,0 +1,88 @@
+package automergendjsonsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/automerge/automerge-go"
+)
+
+// PeerPhase describes how far a connection to a server has progressed.
+type PeerPhase string
+
+const (
+	PeerConnecting PeerPhase = "connecting"
+	PeerConnected  PeerPhase = "connected"
+	PeerReceived   PeerPhase = "received"
+	PeerFinished   PeerPhase = "finished"
+	PeerFailed     PeerPhase = "failed"
+)
+
+// PeerStatus is the status of a connection to a single server, as reported through WithPeerStatusCallback and
+// returned from SyncWithPeers.
+type PeerStatus struct {
+	// Url is the url of the server.
+	Url string
+	// Phase is how far the connection has progressed.
+	Phase PeerPhase
+	// State is the sync state used with this server. It can be passed back in to a later sync with the same server.
+	State *automerge.SyncState
+	// ReceivedMessages is the number of sync messages received from the server so far.
+	ReceivedMessages int
+	// RemoteHeads are the heads of the server as of the last received message.
+	RemoteHeads []automerge.ChangeHash
+	// Err is the error that ended the connection, if any.
+	Err error
+}
+
+// SyncWithPeers synchronises the doc with multiple servers concurrently through HttpPushPullChanges. Each server gets
+// its own SyncState, and because every connection subscribes to the changes received by the SharedDoc, changes
+// received from one server are relayed on to the others. The options apply to every connection. Use
+// WithPeerStatusCallback to observe the status of each connection while it runs. This returns once every connection
+// has finished or the context is cancelled, with the final status for each url in the same order along with the
+// joined errors of all the peers.
+func (b *SharedDoc) SyncWithPeers(ctx context.Context, urls []string, opts ...ClientOption) ([]PeerStatus, error) {
+	log := Logger(ctx)
+	if newClientOptions(opts...).state != nil {
+		return nil, fmt.Errorf("a client sync state cannot be used with multiple peers")
+	}
+
+	statuses := make([]PeerStatus, len(urls))
+	mutex := new(sync.Mutex)
+	wg := new(sync.WaitGroup)
+	for i, url := range urls {
+		statuses[i] = PeerStatus{Url: url, Phase: PeerConnecting, State: automerge.NewSyncState(b.Doc())}
+		peerOpts := append(opts[:len(opts):len(opts)], WithClientSyncState(statuses[i].State), func(o *clientOptions) {
+			inner := o.statusCallback
+			o.statusCallback = func(status PeerStatus) {
+				mutex.Lock()
+				statuses[i] = status
+				mutex.Unlock()
+				if inner != nil {
+					inner(status)
+				}
+			}
+		})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := b.HttpPushPullChanges(ctx, url, peerOpts...); err != nil {
+				log.WarnContext(ctx, "sync with peer failed", slog.String("url", url), slog.Any("err", err))
+			} else {
+				log.InfoContext(ctx, "sync with peer finished", slog.String("url", url))
+			}
+		}()
+	}
+	wg.Wait()
+
+	errs := make([]error, 0, len(statuses))
+	for _, status := range statuses {
+		if status.Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", status.Url, status.Err))
+		}
+	}
+	return statuses, errors.Join(errs...)
+}
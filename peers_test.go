@@ -0,0 +1,109 @@
+package automergendjsonsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/automerge/automerge-go"
+)
+
+func TestSyncWithPeers(t *testing.T) {
+	t.Parallel()
+
+	urls := make([]string, 0)
+	servers := make([]*SharedDoc, 0)
+	for i := 0; i < 2; i++ {
+		sd := NewSharedDoc(automerge.New())
+		assertEqual(t, sd.Doc().RootMap().Set(fmt.Sprintf("server-%d", i), int64(i)), nil)
+		_, _ = sd.Doc().Commit("change")
+		servers = append(servers, sd)
+		urls = append(urls, startTestServer(t, &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_ = sd.ServeChanges(w, r)
+		})}))
+	}
+
+	peerDoc := NewSharedDoc(automerge.New())
+	assertEqual(t, peerDoc.Doc().RootMap().Set("peer", "x"), nil)
+	_, _ = peerDoc.Doc().Commit("change")
+
+	// Without a termination check the connections stay open, so we cancel once the servers have converged.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	go func() {
+		for ctx.Err() == nil {
+			heads := peerDoc.Doc().Heads()
+			if len(heads) == 3 && slices.Equal(servers[0].Doc().Heads(), heads) && slices.Equal(servers[1].Doc().Heads(), heads) {
+				cancel()
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}()
+
+	statuses, err := peerDoc.SyncWithPeers(ctx, urls)
+	assertEqual(t, errors.Is(err, context.Canceled), true)
+	assertEqual(t, len(statuses), 2)
+	for i, status := range statuses {
+		assertEqual(t, status.Url, urls[i])
+		assertEqual(t, status.Phase, PeerFailed)
+		assertEqual(t, errors.Is(status.Err, context.Canceled), true)
+		assertEqual(t, status.State != nil, true)
+		// changes from the other server should have been relayed through the peer
+		assertEqual(t, servers[i].Doc().Heads(), peerDoc.Doc().Heads())
+	}
+	assertEqual(t, peerDoc.Doc().RootMap().Len(), 3)
+}
+
+func TestSyncWithPeers_status_callback(t *testing.T) {
+	t.Parallel()
+
+	sd := NewSharedDoc(automerge.New())
+	assertEqual(t, sd.Doc().RootMap().Set("a", "b"), nil)
+	_, _ = sd.Doc().Commit("change")
+	url := startTestServer(t, &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = sd.ServeChanges(w, r)
+	})})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	mutex := new(sync.Mutex)
+	phases := make([]PeerPhase, 0)
+	peerDoc := NewSharedDoc(automerge.New())
+	statuses, err := peerDoc.SyncWithPeers(ctx, []string{url}, WithClientTerminationCheck(HasAllRemoteHeads), WithPeerStatusCallback(func(status PeerStatus) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		assertEqual(t, status.Url, url)
+		if len(phases) == 0 || phases[len(phases)-1] != status.Phase {
+			phases = append(phases, status.Phase)
+		}
+	}))
+	assertEqual(t, err, nil)
+	assertEqual(t, phases, []PeerPhase{PeerConnected, PeerReceived, PeerFinished})
+	assertEqual(t, statuses[0].Phase, PeerFinished)
+	assertEqual(t, statuses[0].RemoteHeads, sd.Doc().Heads())
+	assertEqual(t, statuses[0].ReceivedMessages > 0, true)
+}
+
+func TestSyncWithPeers_failure(t *testing.T) {
+	t.Parallel()
+	peerDoc := NewSharedDoc(automerge.New())
+	statuses, err := peerDoc.SyncWithPeers(context.Background(), []string{"https://localhost"}, WithHttpClient(HttpDoerFunc(func(request *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusBadGateway}, nil
+	})))
+	assertErrorEqual(t, err, "https://localhost: http request failed with status 502")
+	assertEqual(t, statuses[0].Phase, PeerFailed)
+	assertErrorEqual(t, statuses[0].Err, "http request failed with status 502")
+}
+
+func TestSyncWithPeers_rejects_sync_state(t *testing.T) {
+	t.Parallel()
+	peerDoc := NewSharedDoc(automerge.New())
+	_, err := peerDoc.SyncWithPeers(context.Background(), []string{"https://localhost"}, WithClientSyncState(automerge.NewSyncState(peerDoc.Doc())))
+	assertErrorEqual(t, err, "a client sync state cannot be used with multiple peers")
+}
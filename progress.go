@@ -0,0 +1,155 @@
+package automergendjsonsync
+
+import (
+	"sync"
+
+	"github.com/automerge/automerge-go"
+)
+
+// SyncProgress is the cumulative progress of a sync, reported to the function given to WithClientProgress,
+// WithServerProgress, or WithStreamProgress after each received and sent message.
+type SyncProgress struct {
+	// ReceivedMessages and ReceivedChanges count the sync messages and changes that have been received into the doc,
+	// while ReceivedBytes counts every message read, including those skipped by the read predicates. The change counts
+	// on both sides may include changes that were sent more than once.
+	ReceivedMessages int
+	ReceivedChanges  int
+	ReceivedBytes    int
+	SentMessages     int
+	SentChanges      int
+	SentBytes        int
+	// MissingRemoteHeads is the number of heads from the last received message that aren't in the local doc yet. The
+	// pull is complete when this is 0.
+	MissingRemoteHeads int
+	// LocalNeed is the number of changes that the last sent message asked the remote for, which are the changes we
+	// know we are missing. More may follow them since we only learn of a change once we have those that depend on it.
+	LocalNeed int
+	// RemoteNeed is the number of changes that the last received message asked us for.
+	RemoteNeed int
+}
+
+// WithStreamProgress calls the function with the progress of the sync after each received and sent message. Calls
+// are never concurrent, so the function must return quickly to avoid holding up the sync.
+func WithStreamProgress(f func(progress SyncProgress)) StreamOption {
+	return func(o *streamOptions) {
+		o.progress = f
+	}
+}
+
+// WithServerProgress calls the function with the progress of the sync after each received and sent message, see
+// WithStreamProgress.
+func WithServerProgress(f func(progress SyncProgress)) ServerOption {
+	return func(o *serverOptions) {
+		o.progress = f
+	}
+}
+
+// WithClientProgress calls the function with the progress of the sync after each received and sent message, see
+// WithStreamProgress. When used with SyncWithPeers, the function is called concurrently for each server.
+func WithClientProgress(f func(progress SyncProgress)) ClientOption {
+	return func(o *clientOptions) {
+		o.progress = f
+	}
+}
+
+type progressTracker struct {
+	mutex    sync.Mutex
+	callback func(progress SyncProgress)
+	progress SyncProgress
+}
+
+// newProgressTracker returns a tracker for the callback, or nil if there is no callback.
+func newProgressTracker(callback func(progress SyncProgress)) *progressTracker {
+	if callback == nil {
+		return nil
+	}
+	return &progressTracker{callback: callback}
+}
+
+// update modifies the progress and reports it if requested. The callback is called with the lock held so that
+// reports from the reader and writer are delivered in order.
+func (t *progressTracker) update(f func(p *SyncProgress), report bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	f(&t.progress)
+	if report {
+		t.callback(t.progress)
+	}
+}
+
+// received reports a message that has been received into the doc.
+func (t *progressTracker) received(doc *automerge.Doc, m *automerge.SyncMessage) {
+	missingInLocal, _ := CompareHeads(doc.Heads(), m.Heads())
+	need, _, _, _ := parseSyncMessageNeedHave(m.Bytes())
+	t.update(func(p *SyncProgress) {
+		p.ReceivedMessages++
+		p.ReceivedChanges += len(m.Changes())
+		p.MissingRemoteHeads = missingInLocal
+		p.RemoteNeed = len(need)
+	}, true)
+}
+
+// terminationCheck wraps the termination check so that each received message is reported before it is checked.
+func (t *progressTracker) terminationCheck(check TerminationCheck) TerminationCheck {
+	if t == nil {
+		return check
+	}
+	return func(doc *automerge.Doc, m *automerge.SyncMessage) bool {
+		t.received(doc, m)
+		return check(doc, m)
+	}
+}
+
+type progressReader struct {
+	reader  messageReader
+	tracker *progressTracker
+}
+
+func (r *progressReader) ReadMessage() (*NdJson, int, error) {
+	e, n, err := r.reader.ReadMessage()
+	if err == nil {
+		r.tracker.update(func(p *SyncProgress) {
+			p.ReceivedBytes += n
+		}, false)
+	}
+	return e, n, err
+}
+
+type progressWriter struct {
+	writer  messageWriter
+	tracker *progressTracker
+}
+
+func (w *progressWriter) WriteMessage(e *NdJson) (int, error) {
+	n, err := w.writer.WriteMessage(e)
+	if err != nil || e.sent == nil {
+		return n, err
+	}
+	w.tracker.update(func(p *SyncProgress) {
+		p.SentMessages++
+		p.SentChanges += e.sent.changes
+		p.SentBytes += n
+		p.LocalNeed = e.sent.needCount()
+	}, true)
+	return n, nil
+}
+
+func (w *progressWriter) Close() error {
+	return closeWriter(w.writer)
+}
+
+// progressTrackReader wraps the reader so that the bytes read are counted by the tracker, if there is one.
+func progressTrackReader(tracker *progressTracker, reader messageReader) messageReader {
+	if tracker == nil {
+		return reader
+	}
+	return &progressReader{reader: reader, tracker: tracker}
+}
+
+// progressTrackWriter wraps the writer so that sent messages are reported by the tracker, if there is one.
+func progressTrackWriter(tracker *progressTracker, writer messageWriter) messageWriter {
+	if tracker == nil {
+		return writer
+	}
+	return &progressWriter{writer: writer, tracker: tracker}
+}
@@ -0,0 +1,116 @@
+package automergendjsonsync
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/automerge/automerge-go"
+)
+
+// progressRecorder collects the reports of a progress callback.
+type progressRecorder struct {
+	mutex   sync.Mutex
+	reports []SyncProgress
+}
+
+func (r *progressRecorder) record(progress SyncProgress) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.reports = append(r.reports, progress)
+}
+
+func (r *progressRecorder) last() SyncProgress {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.reports) == 0 {
+		return SyncProgress{}
+	}
+	return r.reports[len(r.reports)-1]
+}
+
+func TestSyncProgress(t *testing.T) {
+	t.Parallel()
+
+	t.Run("stream", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		a, b := NewSharedDoc(automerge.New()), NewSharedDoc(automerge.New())
+		for i := 0; i < 5; i++ {
+			assertEqual(t, a.Doc().RootMap().Set("a", int64(i)), nil)
+			_, _ = a.Doc().Commit("change")
+		}
+		aProgress, bProgress := new(progressRecorder), new(progressRecorder)
+		assertEqual(t, SyncSharedDocs(ctx,
+			a, []StreamOption{WithStreamTerminationCheck(HeadsEqualCheck), WithStreamProgress(aProgress.record)},
+			b, []StreamOption{WithStreamTerminationCheck(HeadsEqualCheck), WithStreamProgress(bProgress.record)},
+		), nil)
+
+		// changes may be sent more than once, depending on how the messages interleave
+		sent, received := aProgress.last(), bProgress.last()
+		assertEqual(t, sent.SentChanges >= 5, true)
+		assertEqual(t, received.ReceivedChanges >= 5, true)
+		assertEqual(t, received.MissingRemoteHeads, 0)
+		assertEqual(t, received.ReceivedBytes > 0, true)
+		assertEqual(t, received.ReceivedBytes <= sent.SentBytes, true)
+	})
+
+	t.Run("missing remote heads", func(t *testing.T) {
+		t.Parallel()
+		doc := automerge.New()
+		m := changeMessage(t, doc, func(doc *automerge.Doc) {
+			assertEqual(t, doc.RootMap().Set("a", "b"), nil)
+		})
+		progress := new(progressRecorder)
+		tracker := newProgressTracker(progress.record)
+		tracker.received(doc, m)
+		assertEqual(t, progress.last(), SyncProgress{ReceivedMessages: 1, ReceivedChanges: 1, MissingRemoteHeads: 1})
+		assertEqual(t, doc.Apply(m.Changes()...), nil)
+		tracker.received(doc, m)
+		assertEqual(t, progress.last(), SyncProgress{ReceivedMessages: 2, ReceivedChanges: 2})
+	})
+
+	t.Run("sent changes", func(t *testing.T) {
+		t.Parallel()
+		m := changeMessage(t, automerge.New(), func(doc *automerge.Doc) {
+			assertEqual(t, doc.RootMap().Set("a", "b"), nil)
+		})
+		for _, strip := range []bool{false, true} {
+			progress := new(progressRecorder)
+			writer := stripWriter(strip, progressTrackWriter(newProgressTracker(progress.record), newMessageWriter(ContentType, io.Discard)))
+			_, err := writer.WriteMessage(newSyncMessageLine(m))
+			assertEqual(t, err, nil)
+			// stripped changes are not sent, so they are not counted
+			assertEqual(t, progress.last().SentMessages, 1)
+			assertEqual(t, progress.last().SentChanges == 1, !strip)
+		}
+	})
+
+	t.Run("http", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		serverDoc := NewSharedDoc(automerge.New())
+		assertEqual(t, serverDoc.Doc().RootMap().Set("a", "b"), nil)
+		_, _ = serverDoc.Doc().Commit("change")
+		serverProgress := new(progressRecorder)
+		serveErrs := make(chan error, 1)
+		url := startTestServer(t, &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			serveErrs <- serverDoc.ServeChanges(w, r, WithServerProgress(serverProgress.record))
+		})})
+
+		clientDoc := NewSharedDoc(automerge.New())
+		clientProgress := new(progressRecorder)
+		assertEqual(t, clientDoc.HttpPushPullChanges(ctx, url, WithClientTerminationCheck(HasAllRemoteHeads), WithClientProgress(clientProgress.record)), nil)
+		assertEqual(t, <-serveErrs, nil)
+		assertEqual(t, clientProgress.last().ReceivedChanges >= 1, true)
+		assertEqual(t, clientProgress.last().MissingRemoteHeads, 0)
+		assertEqual(t, serverProgress.last().SentChanges >= 1, true)
+	})
+}
@@ -0,0 +1,229 @@
+package automergendjsonsync
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimit configures a pair of token buckets which limit the rate of messages and bytes received from a peer. A zero
+// rate means that the quantity is not limited.
+type RateLimit struct {
+	// MessagesPerSecond is the sustained rate of received messages.
+	MessagesPerSecond float64
+	// MessageBurst is the number of messages that may be received at once after a quiet period. It defaults to the
+	// rate rounded up.
+	MessageBurst int
+	// BytesPerSecond is the sustained rate of received bytes, as measured on the wire.
+	BytesPerSecond float64
+	// ByteBurst is the number of bytes that may be received at once after a quiet period. It defaults to the rate
+	// rounded up. When rejecting, this must be larger than the largest expected message.
+	ByteBurst int
+	// Reject ends the sync with an error when a message exceeds the limit. Otherwise the reading of the request body
+	// is slowed until the limit allows the message, which pushes back on the peer through flow control.
+	Reject bool
+}
+
+// tokenBucket holds tokens which refill at a fixed rate up to the burst size.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+}
+
+func newTokenBucket(rate float64, burst int) tokenBucket {
+	b := float64(burst)
+	if burst <= 0 {
+		b = math.Ceil(rate)
+	}
+	return tokenBucket{rate: rate, burst: b, tokens: b}
+}
+
+func (b *tokenBucket) refill(elapsed time.Duration) {
+	b.tokens = min(b.burst, b.tokens+elapsed.Seconds()*b.rate)
+}
+
+// wait returns how long until the bucket is no longer in debt.
+func (b *tokenBucket) wait() time.Duration {
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+type rateLimiter struct {
+	mutex    sync.Mutex
+	name     string
+	reject   bool
+	last     time.Time
+	messages *tokenBucket
+	bytes    *tokenBucket
+}
+
+func newRateLimiter(name string, limit RateLimit, now time.Time) *rateLimiter {
+	l := &rateLimiter{name: name, reject: limit.Reject, last: now}
+	if limit.MessagesPerSecond > 0 {
+		b := newTokenBucket(limit.MessagesPerSecond, limit.MessageBurst)
+		l.messages = &b
+	}
+	if limit.BytesPerSecond > 0 {
+		b := newTokenBucket(limit.BytesPerSecond, limit.ByteBurst)
+		l.bytes = &b
+	}
+	return l
+}
+
+func (l *rateLimiter) buckets() []*tokenBucket {
+	out := make([]*tokenBucket, 0, 2)
+	for _, b := range []*tokenBucket{l.messages, l.bytes} {
+		if b != nil {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+func (l *rateLimiter) refill(now time.Time) {
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		for _, b := range l.buckets() {
+			b.refill(elapsed)
+		}
+		l.last = now
+	}
+}
+
+// take removes a message of n bytes from the buckets and returns how long to wait before it may be received. When
+// rejecting, false is returned instead if there aren't enough tokens, and none are taken.
+func (l *rateLimiter) take(now time.Time, n int) (time.Duration, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.refill(now)
+	if l.reject && ((l.messages != nil && l.messages.tokens < 1) || (l.bytes != nil && l.bytes.tokens < float64(n))) {
+		return 0, false
+	}
+	if l.messages != nil {
+		l.messages.tokens -= 1
+	}
+	if l.bytes != nil {
+		l.bytes.tokens -= float64(n)
+	}
+	var wait time.Duration
+	for _, b := range l.buckets() {
+		wait = max(wait, b.wait())
+	}
+	return wait, true
+}
+
+// idle returns true if the buckets are full, meaning that forgetting the limiter would change nothing.
+func (l *rateLimiter) idle(now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.refill(now)
+	for _, b := range l.buckets() {
+		if b.tokens < b.burst {
+			return false
+		}
+	}
+	return true
+}
+
+// IdentityRateLimiter shares a RateLimit between all the connections of each identity, so that a peer can't avoid the
+// limit by opening more connections. Pass the same IdentityRateLimiter to every ServeChanges call with
+// WithIdentityRateLimit.
+type IdentityRateLimiter struct {
+	mutex    sync.Mutex
+	limit    RateLimit
+	limiters map[string]*identityLimiter
+}
+
+// identityLimiter is the limiter of an identity along with the number of connections that are using it.
+type identityLimiter struct {
+	limiter *rateLimiter
+	holders int
+}
+
+// NewIdentityRateLimiter returns an IdentityRateLimiter which applies the limit to each identity.
+func NewIdentityRateLimiter(limit RateLimit) *IdentityRateLimiter {
+	return &IdentityRateLimiter{limit: limit, limiters: make(map[string]*identityLimiter)}
+}
+
+// acquire returns the limiter for the identity and a function to release it when the connection has finished. The
+// limiters of other identities that have no connections and have been idle long enough to refill are removed when a
+// new one is added, so the map doesn't grow with every identity ever seen.
+func (l *IdentityRateLimiter) acquire(identity string, now time.Time) (*rateLimiter, func()) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	v, ok := l.limiters[identity]
+	if !ok {
+		for k, other := range l.limiters {
+			if other.holders == 0 && other.limiter.idle(now) {
+				delete(l.limiters, k)
+			}
+		}
+		v = &identityLimiter{limiter: newRateLimiter(fmt.Sprintf("identity '%s'", identity), l.limit, now)}
+		l.limiters[identity] = v
+	}
+	v.holders++
+	return v.limiter, sync.OnceFunc(func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		v.holders--
+	})
+}
+
+// WithConnectionRateLimit limits the rate of messages and bytes received on each request.
+func WithConnectionRateLimit(limit RateLimit) ServerOption {
+	return func(o *serverOptions) {
+		o.connectionRateLimit = &limit
+	}
+}
+
+// WithIdentityRateLimit limits the rate of messages and bytes received across all requests from each identity. The
+// identity comes from the request context, see WithServerIdentity, and requests without an identity are not limited
+// by this.
+func WithIdentityRateLimit(limiter *IdentityRateLimiter) ServerOption {
+	return func(o *serverOptions) {
+		o.identityRateLimiter = limiter
+	}
+}
+
+type rateLimitingReader struct {
+	ctx      context.Context
+	reader   messageReader
+	limiters []*rateLimiter
+}
+
+func (r *rateLimitingReader) ReadMessage() (*NdJson, int, error) {
+	e, n, err := r.reader.ReadMessage()
+	if err != nil {
+		return e, n, err
+	}
+	var wait time.Duration
+	for _, l := range r.limiters {
+		d, ok := l.take(time.Now(), n)
+		if !ok {
+			return nil, 0, fmt.Errorf("%s rate limit exceeded", l.name)
+		}
+		wait = max(wait, d)
+	}
+	if wait > 0 {
+		t := time.NewTimer(wait)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-r.ctx.Done():
+			return nil, 0, r.ctx.Err()
+		}
+	}
+	return e, n, nil
+}
+
+// rateLimitReader wraps the reader so that each message is delayed or rejected by the rate limiters, if there are any.
+func rateLimitReader(ctx context.Context, limiters []*rateLimiter, reader messageReader) messageReader {
+	if len(limiters) == 0 {
+		return reader
+	}
+	return &rateLimitingReader{ctx: ctx, reader: reader, limiters: limiters}
+}
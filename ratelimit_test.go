@@ -0,0 +1,134 @@
+package automergendjsonsync
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/automerge/automerge-go"
+)
+
+func TestRateLimiter_take(t *testing.T) {
+	t.Parallel()
+	start := time.Now()
+
+	t.Run("wait", func(t *testing.T) {
+		l := newRateLimiter("test", RateLimit{MessagesPerSecond: 2, MessageBurst: 2, BytesPerSecond: 100}, start)
+		wait, ok := l.take(start, 50)
+		assertEqual(t, ok, true)
+		assertEqual(t, wait, time.Duration(0))
+		// the byte bucket is now in debt by 50 bytes which takes half a second to refill
+		wait, _ = l.take(start, 100)
+		assertEqual(t, wait, 500*time.Millisecond)
+		// after refilling, a third message puts the message bucket in debt which also takes half a second to refill
+		wait, _ = l.take(start.Add(time.Second), 0)
+		assertEqual(t, wait, time.Duration(0))
+		wait, _ = l.take(start.Add(time.Second), 0)
+		assertEqual(t, wait, time.Duration(0))
+		wait, _ = l.take(start.Add(time.Second), 0)
+		assertEqual(t, wait, 500*time.Millisecond)
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		l := newRateLimiter("test", RateLimit{MessagesPerSecond: 1, Reject: true}, start)
+		_, ok := l.take(start, 10)
+		assertEqual(t, ok, true)
+		_, ok = l.take(start, 10)
+		assertEqual(t, ok, false)
+		_, ok = l.take(start.Add(time.Second), 10)
+		assertEqual(t, ok, true)
+	})
+
+	t.Run("unlimited", func(t *testing.T) {
+		l := newRateLimiter("test", RateLimit{}, start)
+		for i := 0; i < 100; i++ {
+			wait, ok := l.take(start, 1000)
+			assertEqual(t, ok, true)
+			assertEqual(t, wait, time.Duration(0))
+		}
+	})
+}
+
+func TestIdentityRateLimiter(t *testing.T) {
+	t.Parallel()
+	start := time.Now()
+	l := NewIdentityRateLimiter(RateLimit{MessagesPerSecond: 1, Reject: true})
+	alice, releaseAlice := l.acquire("alice", start)
+	other, releaseOther := l.acquire("alice", start)
+	assertEqual(t, other == alice, true)
+	releaseOther()
+	_, ok := alice.take(start, 0)
+	assertEqual(t, ok, true)
+	// a busy limiter is kept when another identity is added
+	_, releaseBob := l.acquire("bob", start)
+	releaseBob()
+	assertEqual(t, len(l.limiters), 2)
+	// an idle limiter is kept while a connection holds it, so a reconnect shares the limiter of the open connection
+	_, releaseCarol := l.acquire("carol", start.Add(time.Minute))
+	releaseCarol()
+	assertEqual(t, len(l.limiters), 2)
+	reconnected, releaseReconnected := l.acquire("alice", start.Add(time.Minute))
+	assertEqual(t, reconnected == alice, true)
+	// but idle ones are forgotten once every connection has finished
+	releaseAlice()
+	releaseReconnected()
+	// releasing more than once has no effect
+	releaseAlice()
+	assertEqual(t, l.limiters["alice"].holders, 0)
+	l.acquire("dave", start.Add(2*time.Minute))
+	assertEqual(t, len(l.limiters), 1)
+}
+
+func TestServeChanges_rate_limit(t *testing.T) {
+	t.Parallel()
+	clientDoc := automerge.New()
+	assertEqual(t, clientDoc.RootMap().Set("a", "b"), nil)
+	_, _ = clientDoc.Commit("change")
+	line, _ := io.ReadAll(changeRequestBody(t, clientDoc))
+	body := strings.Repeat(string(line), 3)
+
+	t.Run("reject", func(t *testing.T) {
+		t.Parallel()
+		sd := NewSharedDoc(automerge.New())
+		req := httptest.NewRequestWithContext(context.Background(), http.MethodPut, "/", strings.NewReader(body))
+		err := sd.ServeChanges(httptest.NewRecorder(), req, WithConnectionRateLimit(RateLimit{MessagesPerSecond: 1, MessageBurst: 2, Reject: true}))
+		assertErrorEqual(t, err, "failed while scanning message 3: connection rate limit exceeded")
+	})
+
+	t.Run("identity reject", func(t *testing.T) {
+		t.Parallel()
+		sd := NewSharedDoc(automerge.New())
+		limiter := NewIdentityRateLimiter(RateLimit{MessagesPerSecond: 1, Reject: true})
+		ctx := SetContextIdentity(context.Background(), "bob")
+		req := httptest.NewRequestWithContext(ctx, http.MethodPut, "/", strings.NewReader(body))
+		err := sd.ServeChanges(httptest.NewRecorder(), req, WithIdentityRateLimit(limiter))
+		assertErrorEqual(t, err, "failed while scanning message 2: identity 'bob' rate limit exceeded")
+		assertEqual(t, limiter.limiters["bob"].holders, 0)
+	})
+
+	t.Run("wait", func(t *testing.T) {
+		t.Parallel()
+		sd := NewSharedDoc(automerge.New())
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		start, inbound := time.Now(), 0
+		var elapsed time.Duration
+		recorder := func(line RecordedLine) {
+			if line.Direction == RecordInbound {
+				if inbound++; inbound == 3 {
+					elapsed = time.Since(start)
+					cancel()
+				}
+			}
+		}
+		req := httptest.NewRequestWithContext(ctx, http.MethodPut, "/", strings.NewReader(body))
+		assertEqual(t, sd.ServeChanges(httptest.NewRecorder(), req, WithServerRecorder(recorder), WithConnectionRateLimit(RateLimit{MessagesPerSecond: 10, MessageBurst: 1})), nil)
+		// the first message is read immediately and each of the others waits for a tenth of a second
+		assertEqual(t, elapsed >= 200*time.Millisecond, true)
+		assertEqual(t, sd.Doc().RootMap().Len(), 1)
+	})
+}
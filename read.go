@@ -1,9 +1,8 @@
 package automergendjsonsync
 
 import (
-	"bufio"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -25,32 +24,48 @@ func (b *SharedDoc) NotifyReceivedChanges() {
 	}
 }
 
-func (b *SharedDoc) consumeMessagesFromReader(ctx context.Context, state *automerge.SyncState, reader io.Reader, readPredicate ReadPredicate, terminationCheck TerminationCheck) (int, error) {
+// consumeMessagesFromReader receives the sync messages from the reader until it ends or the termination check is met.
+// If stripChanges is set, the changes are dropped from each message before it is checked and received, so the sync
+// state still learns the heads and needs of the peer without the doc being modified.
+func (b *SharedDoc) consumeMessagesFromReader(ctx context.Context, state *automerge.SyncState, reader messageReader, readPredicate LineReadPredicate, terminationCheck TerminationCheck, stripChanges bool) (int, error) {
 	log := Logger(ctx)
 	received, receivedBytes, receivedChanges := 0, 0, 0
 	defer func() {
 		log.InfoContext(ctx, "finished receiving sync messages", slog.Int("received-messages", received), slog.Int("received-changes", receivedChanges), slog.Int("received-bytes", receivedBytes))
 	}()
 
-	sc := bufio.NewScanner(reader)
-	for sc.Scan() {
-		e := &NdJson{}
-		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
-			return received, fmt.Errorf("failed to unmarshal message %d: %w", received+1, err)
+	for {
+		e, n, err := reader.ReadMessage()
+		var malformed *malformedMessageError
+		if errors.Is(err, io.EOF) {
+			return received, nil
+		} else if errors.As(err, &malformed) {
+			return received, fmt.Errorf("failed to unmarshal message %d: %w", received+1, malformed.err)
+		} else if err != nil {
+			return received, fmt.Errorf("failed while scanning message %d: %w", received+1, err)
+		} else if e.Event == EventGoodbye {
+			log.InfoContext(ctx, "peer said goodbye")
+			return received, ErrPeerGoodbye
 		} else if e.Event == EventSync {
-			if m, err := automerge.LoadSyncMessage(e.Data); err != nil {
+			data := e.Data
+			if stripChanges {
+				if data, err = stripSyncMessageChanges(data); err != nil {
+					return received, fmt.Errorf("failed to strip changes from message %d: %w", received+1, err)
+				}
+			}
+			if m, err := automerge.LoadSyncMessage(data); err != nil {
 				return received, fmt.Errorf("failed to load message %d: %w", received+1, err)
-			} else if ok, err := readPredicate(state.Doc, m); err != nil {
+			} else if ok, err := readPredicate(ctx, e, state.Doc, m); err != nil {
 				return received, fmt.Errorf("failed to run read predicate on message %d: %w", received+1, err)
 			} else if !ok {
-				log.DebugContext(ctx, "skipping message", slog.Int("changes", len(m.Changes())), slog.Int("bytes", len(sc.Bytes())), slog.Any("heads", LoggableChangeHashes(m.Heads())))
-			} else if _, err := state.ReceiveMessage(e.Data); err != nil {
+				log.DebugContext(ctx, "skipping message", slog.Int("changes", len(m.Changes())), slog.Int("bytes", n), slog.Any("heads", LoggableChangeHashes(m.Heads())))
+			} else if _, err := state.ReceiveMessage(data); err != nil {
 				return received, fmt.Errorf("failed to receive message %d: %w", received+1, err)
 			} else {
-				log.DebugContext(ctx, "received message", slog.Int("changes", len(m.Changes())), slog.Int("bytes", len(sc.Bytes())), slog.Any("heads", LoggableChangeHashes(m.Heads())))
+				log.DebugContext(ctx, "received message", slog.Int("changes", len(m.Changes())), slog.Int("bytes", n), slog.Any("heads", LoggableChangeHashes(m.Heads())))
 				received += 1
 				receivedChanges += len(m.Changes())
-				receivedBytes += len(sc.Bytes()) + 1
+				receivedBytes += n
 				b.NotifyReceivedChanges()
 
 				if terminationCheck(state.Doc, m) {
@@ -60,8 +75,4 @@ func (b *SharedDoc) consumeMessagesFromReader(ctx context.Context, state *autome
 			}
 		}
 	}
-	if sc.Err() != nil {
-		return received, fmt.Errorf("failed while scanning message %d: %w", received+1, sc.Err())
-	}
-	return received, nil
 }
@@ -1,6 +1,12 @@
 package automergendjsonsync
 
-import "github.com/automerge/automerge-go"
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/automerge/automerge-go"
+)
 
 // A ReadPredicate is used to filter messages before receiving them in the doc.
 // The function should return a bool (true=include, false=exclude/skip).
@@ -17,3 +23,44 @@ func NoReadPredicate(doc *automerge.Doc, msg *automerge.SyncMessage) (bool, erro
 func SkipChangesReadPredicate(doc *automerge.Doc, msg *automerge.SyncMessage) (bool, error) {
 	return len(msg.Changes()) == 0, nil
 }
+
+// TrustedActorsReadPredicate returns a ReadPredicate which aborts the sync if a message contains a new change from an
+// actor that is not in the trusted set. This lets a follower refuse the writes of a compromised server. Changes that
+// are already in the doc are not checked.
+func TrustedActorsReadPredicate(actorIds ...string) ReadPredicate {
+	return func(doc *automerge.Doc, msg *automerge.SyncMessage) (bool, error) {
+		for _, change := range msg.Changes() {
+			if _, err := doc.Change(change.Hash()); err == nil {
+				continue
+			} else if !slices.Contains(actorIds, change.ActorID()) {
+				return false, fmt.Errorf("change from untrusted actor '%s'", change.ActorID())
+			}
+		}
+		return true, nil
+	}
+}
+
+// A LineReadPredicate is like a ReadPredicate but also has access to the context of the sync, and to the line that
+// carried the message. This allows it to check fields of the line such as the signature, or to check the message
+// against the identity of the peer.
+type LineReadPredicate func(ctx context.Context, line *NdJson, doc *automerge.Doc, msg *automerge.SyncMessage) (bool, error)
+
+// Line converts the ReadPredicate into a LineReadPredicate.
+func (f ReadPredicate) Line() LineReadPredicate {
+	return func(ctx context.Context, line *NdJson, doc *automerge.Doc, msg *automerge.SyncMessage) (bool, error) {
+		return f(doc, msg)
+	}
+}
+
+// AllLineReadPredicates returns a LineReadPredicate which only includes a message if all the predicates include it. The
+// predicates are run in order and stop at the first one that excludes the message or returns an error.
+func AllLineReadPredicates(predicates ...LineReadPredicate) LineReadPredicate {
+	return func(ctx context.Context, line *NdJson, doc *automerge.Doc, msg *automerge.SyncMessage) (bool, error) {
+		for _, predicate := range predicates {
+			if ok, err := predicate(ctx, line, doc, msg); err != nil || !ok {
+				return ok, err
+			}
+		}
+		return true, nil
+	}
+}
@@ -0,0 +1,30 @@
+package automergendjsonsync
+
+import (
+	"testing"
+
+	"github.com/automerge/automerge-go"
+)
+
+func TestTrustedActorsReadPredicate(t *testing.T) {
+	t.Parallel()
+	doc := automerge.New()
+	m := changeMessage(t, doc, func(doc *automerge.Doc) {
+		assertEqual(t, doc.RootMap().Set("a", "b"), nil)
+	})
+	actorId := m.Changes()[0].ActorID()
+
+	ok, err := TrustedActorsReadPredicate("other", actorId)(doc, m)
+	assertEqual(t, err, nil)
+	assertEqual(t, ok, true)
+
+	_, err = TrustedActorsReadPredicate("other")(doc, m)
+	assertErrorEqual(t, err, "change from untrusted actor '"+actorId+"'")
+
+	// changes that are already in the doc are not checked
+	err = doc.Apply(m.Changes()...)
+	assertEqual(t, err, nil)
+	ok, err = TrustedActorsReadPredicate()(doc, m)
+	assertEqual(t, err, nil)
+	assertEqual(t, ok, true)
+}
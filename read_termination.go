@@ -47,3 +47,13 @@ func HasAllRemoteHeads(doc *automerge.Doc, m *automerge.SyncMessage) bool {
 }
 
 var _ TerminationCheck = HasAllRemoteHeads
+
+// RemoteHasAllLocalHeads will continue accepting messages until it confirms that the remote doc contains all the local
+// heads. This is useful when pushing local changes. If the remote has made further changes on top of the local heads,
+// this is only met once those changes have been received locally too.
+func RemoteHasAllLocalHeads(doc *automerge.Doc, m *automerge.SyncMessage) bool {
+	_, missingInRemote := CompareHeads(doc.Heads(), m.Heads())
+	return missingInRemote == 0
+}
+
+var _ TerminationCheck = RemoteHasAllLocalHeads
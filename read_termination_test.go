@@ -57,3 +57,24 @@ func TestHeadsEqualCheck(t *testing.T) {
 		assertEqual(t, HeadsEqualCheck(doc, m), false)
 	})
 }
+
+func TestRemoteHasAllLocalHeads(t *testing.T) {
+	t.Parallel()
+
+	remote := automerge.New()
+	_ = remote.RootMap().Set("a", "b")
+	_, _ = remote.Commit("done")
+	m, _ := automerge.NewSyncState(remote).GenerateMessage()
+
+	t.Run("true", func(t *testing.T) {
+		local, _ := remote.Fork()
+		assertEqual(t, RemoteHasAllLocalHeads(local, m), true)
+	})
+
+	t.Run("false", func(t *testing.T) {
+		local, _ := remote.Fork()
+		_ = local.RootMap().Set("a", "c")
+		_, _ = local.Commit("done")
+		assertEqual(t, RemoteHasAllLocalHeads(local, m), false)
+	})
+}
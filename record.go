@@ -0,0 +1,141 @@
+package automergendjsonsync
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/automerge/automerge-go"
+)
+
+// RecordDirection is the direction of a recorded message relative to the peer doing the recording.
+type RecordDirection string
+
+const (
+	RecordInbound  RecordDirection = "in"
+	RecordOutbound RecordDirection = "out"
+)
+
+// RecordedLine is a single message that was received or sent during a sync session. Messages are recorded in the
+// NdJson form regardless of the wire format that was used.
+type RecordedLine struct {
+	Time      time.Time       `json:"time"`
+	Direction RecordDirection `json:"direction"`
+	Line      *NdJson         `json:"line"`
+}
+
+// Recorder is called with every message that is read or written during a sync session. Reading and writing happen
+// concurrently, so the recorder must be safe to call from multiple goroutines.
+type Recorder func(line RecordedLine)
+
+// NewNdJsonRecorder returns a Recorder that writes each recorded line as a line of json to the writer. This is the
+// format that ReplayRecording reads. Write errors are ignored so that a failing recording never affects the sync.
+func NewNdJsonRecorder(w io.Writer) Recorder {
+	mutex := new(sync.Mutex)
+	return func(line RecordedLine) {
+		raw, err := json.Marshal(line)
+		if err != nil {
+			return
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		_, _ = w.Write(append(raw, '\n'))
+	}
+}
+
+type recordingReader struct {
+	reader   messageReader
+	recorder Recorder
+}
+
+func (r *recordingReader) ReadMessage() (*NdJson, int, error) {
+	e, n, err := r.reader.ReadMessage()
+	if err == nil {
+		r.recorder(RecordedLine{Time: time.Now(), Direction: RecordInbound, Line: e})
+	}
+	return e, n, err
+}
+
+type recordingWriter struct {
+	writer   messageWriter
+	recorder Recorder
+}
+
+func (w *recordingWriter) WriteMessage(e *NdJson) (int, error) {
+	n, err := w.writer.WriteMessage(e)
+	if err == nil {
+		w.recorder(RecordedLine{Time: time.Now(), Direction: RecordOutbound, Line: e})
+	}
+	return n, err
+}
+
+func (w *recordingWriter) Close() error {
+	return closeWriter(w.writer)
+}
+
+// recordReader wraps the reader so that each message is passed to the recorder, if there is one.
+func recordReader(recorder Recorder, reader messageReader) messageReader {
+	if recorder == nil {
+		return reader
+	}
+	return &recordingReader{reader: reader, recorder: recorder}
+}
+
+// recordWriter wraps the writer so that each message is passed to the recorder, if there is one.
+func recordWriter(recorder Recorder, writer messageWriter) messageWriter {
+	if recorder == nil {
+		return writer
+	}
+	return &recordingWriter{writer: writer, recorder: recorder}
+}
+
+// replayReader is a messageReader over the inbound lines of a recording. Since the consumer processes each message
+// before reading the next one, the step function for a message is called when the following message, or the end of
+// the recording, is requested.
+type replayReader struct {
+	scanner *bufio.Scanner
+	doc     *automerge.Doc
+	step    func(line RecordedLine, doc *automerge.Doc) error
+	pending *RecordedLine
+}
+
+func (r *replayReader) ReadMessage() (*NdJson, int, error) {
+	if r.pending != nil {
+		pending := r.pending
+		r.pending = nil
+		if err := r.step(*pending, r.doc); err != nil {
+			return nil, 0, err
+		}
+	}
+	for r.scanner.Scan() {
+		line := new(RecordedLine)
+		if err := json.Unmarshal(r.scanner.Bytes(), line); err != nil {
+			return nil, 0, &malformedMessageError{err: err}
+		} else if line.Direction != RecordInbound || line.Line == nil {
+			continue
+		}
+		if r.step != nil {
+			r.pending = line
+		}
+		return line.Line, len(r.scanner.Bytes()) + 1, nil
+	}
+	if r.scanner.Err() != nil {
+		return nil, 0, r.scanner.Err()
+	}
+	return nil, 0, io.EOF
+}
+
+// ReplayRecording feeds the inbound messages of a recording made with NewNdJsonRecorder into the doc, in the same way
+// that they were received during the original session. Replaying against a fresh doc reproduces the document state
+// of the peer that made the recording, provided that it started from an empty doc. The optional step function is
+// called after each message has been processed and may return an error to stop the replay early. The number of
+// messages received is returned.
+func (b *SharedDoc) ReplayRecording(ctx context.Context, r io.Reader, step func(line RecordedLine, doc *automerge.Doc) error) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxBinaryFrameSize)
+	reader := &replayReader{scanner: scanner, doc: b.Doc(), step: step}
+	return b.consumeMessagesFromReader(ctx, automerge.NewSyncState(b.Doc()), reader, ReadPredicate(NoReadPredicate).Line(), NoTerminationCheck, false)
+}
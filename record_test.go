@@ -0,0 +1,78 @@
+package automergendjsonsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/automerge/automerge-go"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	t.Parallel()
+
+	sd := NewSharedDoc(automerge.New())
+	assertEqual(t, sd.Doc().RootMap().Set("a", "b"), nil)
+	_, _ = sd.Doc().Commit("change")
+
+	serverRecording := new(bytes.Buffer)
+	serverRecordingMutex := new(sync.Mutex)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		serverRecordingMutex.Lock()
+		defer serverRecordingMutex.Unlock()
+		if err := sd.ServeChanges(w, r, WithServerRecorder(NewNdJsonRecorder(serverRecording))); err != nil {
+			t.Error(err)
+		}
+	})
+	serverUrl := startTestServer(t, &http.Server{Handler: mux})
+
+	recording := new(bytes.Buffer)
+	peerDoc := NewSharedDoc(automerge.New())
+	assertEqual(t, peerDoc.HttpPushPullChanges(context.Background(), serverUrl,
+		WithClientContentType(ContentTypeBinary),
+		WithClientTerminationCheck(HasAllRemoteHeads),
+		WithClientRecorder(NewNdJsonRecorder(recording)),
+	), nil)
+	assertEqual(t, strings.Contains(recording.String(), `"direction":"in"`), true)
+	assertEqual(t, strings.Contains(recording.String(), `"direction":"out"`), true)
+
+	// Replaying the client recording into a fresh doc reproduces the state of the client.
+	replayDoc := NewSharedDoc(automerge.New())
+	steps := 0
+	received, err := replayDoc.ReplayRecording(context.Background(), bytes.NewReader(recording.Bytes()), func(line RecordedLine, doc *automerge.Doc) error {
+		steps++
+		assertEqual(t, line.Direction, RecordInbound)
+		return nil
+	})
+	assertEqual(t, err, nil)
+	assertEqual(t, received > 0, true)
+	assertEqual(t, steps, received)
+	assertEqual(t, replayDoc.Doc().Heads(), peerDoc.Doc().Heads())
+
+	// The server recorded the other side of the conversation.
+	serverRecordingMutex.Lock()
+	defer serverRecordingMutex.Unlock()
+	assertEqual(t, strings.Contains(serverRecording.String(), `"direction":"in"`), true)
+}
+
+func TestReplayRecording_step_error(t *testing.T) {
+	t.Parallel()
+	doc := automerge.New()
+	m, _ := automerge.NewSyncState(doc).GenerateMessage()
+	recording := new(bytes.Buffer)
+	recorder := NewNdJsonRecorder(recording)
+	recorder(RecordedLine{Direction: RecordOutbound, Line: &NdJson{Event: EventSync, Data: []byte("ignored")}})
+	recorder(RecordedLine{Direction: RecordInbound, Line: &NdJson{Event: EventSync, Data: m.Bytes()}})
+	recorder(RecordedLine{Direction: RecordInbound, Line: &NdJson{Event: EventSync, Data: m.Bytes()}})
+
+	received, err := NewSharedDoc(automerge.New()).ReplayRecording(context.Background(), recording, func(line RecordedLine, doc *automerge.Doc) error {
+		return errors.New("stop")
+	})
+	assertEqual(t, received, 1)
+	assertErrorEqual(t, err, "failed while scanning message 2: stop")
+}
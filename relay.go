@@ -0,0 +1,161 @@
+package automergendjsonsync
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+)
+
+// BlindRelay forwards encrypted messages between two peers without decoding them, so the relay never holds the
+// document or the keys. The sync protocol is between exactly two sync states, so the relay pairs the first two
+// connections to each room and rejects any more with a 409 Conflict. When either peer of a pair disconnects, the
+// other connection is ended too so that both peers can reconnect and start a fresh sync.
+type BlindRelay struct {
+	mutex sync.Mutex
+	rooms map[string]*relayRoom
+}
+
+type relayRoom struct {
+	peers  [2]chan *NdJson
+	joined int
+	paired chan struct{}
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (r *relayRoom) close() {
+	r.once.Do(func() {
+		close(r.closed)
+	})
+}
+
+// NewBlindRelay returns a new BlindRelay with no rooms.
+func NewBlindRelay() *BlindRelay {
+	return &BlindRelay{rooms: make(map[string]*relayRoom)}
+}
+
+// join adds a connection to the room, returning the room and the index of the connection within it.
+func (r *BlindRelay) join(roomId string) (*relayRoom, int, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	room, ok := r.rooms[roomId]
+	if !ok {
+		room = &relayRoom{paired: make(chan struct{}), closed: make(chan struct{})}
+		r.rooms[roomId] = room
+	} else if room.joined == len(room.peers) {
+		return nil, 0, false
+	}
+	self := room.joined
+	room.peers[self] = make(chan *NdJson)
+	room.joined++
+	if room.joined == len(room.peers) {
+		close(room.paired)
+	}
+	return room, self, true
+}
+
+// leave ends the pairing and removes the room so that the next connection starts a new one.
+func (r *BlindRelay) leave(roomId string, room *relayRoom) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	room.close()
+	if r.rooms[roomId] == room {
+		delete(r.rooms, roomId)
+	}
+}
+
+// ServeRelay handles a sync request from a peer, in the same way as ServeChanges, but forwards the messages to and
+// from the other peer in the room rather than syncing them with a doc. Messages with data must be encrypted, which
+// prevents a peer that is missing WithClientEncryption from leaking the document through the relay. The two peers
+// may use different wire formats. Only the header editor and recorder options apply to the relay.
+func (r *BlindRelay) ServeRelay(rw http.ResponseWriter, req *http.Request, roomId string, opts ...ServerOption) error {
+	log := Logger(req.Context()).With(slog.String("room", roomId))
+	options := newServerOptions(opts...)
+
+	requestContentType, responseContentType, ok := negotiateContentTypes(rw, req)
+	if !ok {
+		return nil
+	}
+	room, self, ok := r.join(roomId)
+	if !ok {
+		rw.WriteHeader(http.StatusConflict)
+		return nil
+	}
+	defer r.leave(roomId, room)
+	ctx := req.Context()
+	startSyncResponse(rw, req, responseContentType, options.headerEditors)
+
+	log.DebugContext(ctx, "waiting for peer")
+	select {
+	case <-room.paired:
+	case <-room.closed:
+		return nil
+	case <-ctx.Done():
+		return nil
+	}
+	log.DebugContext(ctx, "paired with peer")
+	inbound, outbound := room.peers[self], room.peers[1-self]
+
+	// Messages from our peer are forwarded to the other peer in the background. The end of the request body means
+	// that the peer has finished syncing, so the pairing ends.
+	readErrs := make(chan error, 1)
+	go func() {
+		defer room.close()
+		readErrs <- forwardMessages(recordReader(options.recorder, newMessageReader(requestContentType, req.Body)), outbound, room.closed)
+	}()
+
+	writer := recordWriter(options.recorder, newMessageWriter(responseContentType, rw))
+	var writeErr error
+	for writeErr == nil {
+		select {
+		case e := <-inbound:
+			_, writeErr = writer.WriteMessage(e)
+		case <-room.closed:
+			writeErr = io.EOF
+		case <-ctx.Done():
+			writeErr = io.EOF
+		}
+	}
+	room.close()
+	// The reader may still be blocked on the request body, in which case the body is closed when we return.
+	var readErr error
+	select {
+	case readErr = <-readErrs:
+	default:
+	}
+
+	if ctx.Err() != nil {
+		log.DebugContext(ctx, "client context closed")
+		return nil
+	} else if errors.Is(readErr, http.ErrBodyReadAfterClose) {
+		return nil
+	} else if readErr != nil {
+		return readErr
+	} else if !errors.Is(writeErr, io.EOF) {
+		return fmt.Errorf("failed to write message: %w", writeErr)
+	}
+	return nil
+}
+
+// forwardMessages sends each message from the reader to the outbound channel until the end of the stream or the
+// room is closed.
+func forwardMessages(reader messageReader, outbound chan<- *NdJson, closed <-chan struct{}) error {
+	for i := 1; ; i++ {
+		e, _, err := reader.ReadMessage()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read message %d: %w", i, err)
+		} else if len(e.Data) > 0 && e.KeyId == "" {
+			return fmt.Errorf("message %d is not encrypted", i)
+		}
+		select {
+		case outbound <- e:
+		case <-closed:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package automergendjsonsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/automerge/automerge-go"
+)
+
+func TestKeyring(t *testing.T) {
+	t.Parallel()
+	old, err := NewKeyring("old", map[string][]byte{"old": bytes.Repeat([]byte{1}, 16)})
+	assertEqual(t, err, nil)
+	rotated, err := NewKeyring("new", map[string][]byte{"old": bytes.Repeat([]byte{1}, 16), "new": bytes.Repeat([]byte{2}, 32)})
+	assertEqual(t, err, nil)
+
+	e, err := old.encrypt(&NdJson{Event: EventSync, Data: []byte("hello")})
+	assertEqual(t, err, nil)
+	assertEqual(t, e.KeyId, "old")
+	assertEqual(t, bytes.Contains(e.Data, []byte("hello")), false)
+
+	// the rotated keyring can still decrypt messages from peers on the old key, but not the other way around
+	d, err := rotated.decrypt(e)
+	assertEqual(t, err, nil)
+	assertEqual(t, d, &NdJson{Event: EventSync, Data: []byte("hello")})
+	e, _ = rotated.encrypt(&NdJson{Event: EventSync, Data: []byte("hello")})
+	_, err = old.decrypt(e)
+	assertErrorEqual(t, err, "unknown key id 'new'")
+
+	// the event is authenticated along with the data
+	e.Event = "other"
+	_, err = rotated.decrypt(e)
+	assertErrorEqual(t, err, "failed to decrypt message with key 'new': cipher: message authentication failed")
+
+	_, err = old.decrypt(&NdJson{Event: EventSync, Data: []byte("hello")})
+	assertErrorEqual(t, err, "message is not encrypted")
+	_, err = NewKeyring("missing", map[string][]byte{"old": bytes.Repeat([]byte{1}, 16)})
+	assertErrorEqual(t, err, "current key id 'missing' is not in the keys")
+	_, err = NewKeyring("bad", map[string][]byte{"bad": {1, 2, 3}})
+	assertErrorEqual(t, err, "invalid key 'bad': crypto/aes: invalid key size 3")
+}
+
+func TestBlindRelay(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	relay := NewBlindRelay()
+	relayed := new(bytes.Buffer)
+	relayedMutex := new(sync.Mutex)
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /{id}", func(w http.ResponseWriter, r *http.Request) {
+		_ = relay.ServeRelay(w, r, r.PathValue("id"), WithServerRecorder(func(line RecordedLine) {
+			relayedMutex.Lock()
+			defer relayedMutex.Unlock()
+			relayed.Write(line.Line.Data)
+		}))
+	})
+	serverUrl := startTestServer(t, &http.Server{Handler: mux})
+
+	keyring, err := NewKeyring("k1", map[string][]byte{"k1": bytes.Repeat([]byte{7}, 32)})
+	assertEqual(t, err, nil)
+
+	docs := []*SharedDoc{NewSharedDoc(automerge.New()), NewSharedDoc(automerge.New())}
+	assertEqual(t, docs[0].Doc().RootMap().Set("secret", "plaintext-value"), nil)
+	_, _ = docs[0].Doc().Commit("change")
+
+	wg := new(sync.WaitGroup)
+	errs := make([]error, len(docs))
+	for i, doc := range docs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = doc.HttpPushPullChanges(ctx, serverUrl+"/room", WithClientEncryption(keyring), WithClientTerminationCheck(HeadsEqualCheck))
+		}()
+	}
+	wg.Wait()
+	assertEqual(t, errors.Join(errs...), nil)
+	assertEqual(t, docs[0].Doc().Heads(), docs[1].Doc().Heads())
+	values, _ := docs[1].Doc().RootMap().Values()
+	assertEqual(t, values["secret"].Str(), "plaintext-value")
+
+	relayedMutex.Lock()
+	defer relayedMutex.Unlock()
+	assertEqual(t, relayed.Len() > 0, true)
+	assertEqual(t, strings.Contains(relayed.String(), "plaintext-value"), false)
+}
+
+// wireCapture is an HttpDoer that captures the request and response bodies as they are sent over the wire.
+type wireCapture struct {
+	mutex    sync.Mutex
+	sent     bytes.Buffer
+	received bytes.Buffer
+}
+
+type lockedWriter struct {
+	mutex  *sync.Mutex
+	buffer *bytes.Buffer
+}
+
+func (w lockedWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.buffer.Write(p)
+}
+
+func (c *wireCapture) Do(r *http.Request) (*http.Response, error) {
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(r.Body, lockedWriter{&c.mutex, &c.sent}), r.Body}
+	res, err := http.DefaultClient.Do(r)
+	if err == nil {
+		res.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(res.Body, lockedWriter{&c.mutex, &c.received}), res.Body}
+	}
+	return res, err
+}
+
+// assertCiphertext checks that every message with data in the captured ndjson stream was encrypted.
+func assertCiphertext(t *testing.T, wire []byte, plaintext string) {
+	t.Helper()
+	// The sync may end part way through reading a line, so only the complete lines are checked.
+	wire = wire[:bytes.LastIndexByte(wire, '\n')+1]
+	reader := newMessageReader(ContentType, bytes.NewReader(wire))
+	encrypted := 0
+	for {
+		e, _, err := reader.ReadMessage()
+		if err != nil {
+			assertEqual(t, err, io.EOF)
+			break
+		} else if len(e.Data) == 0 {
+			continue
+		}
+		encrypted++
+		assertEqual(t, e.KeyId, "k1")
+		assertEqual(t, bytes.Contains(e.Data, []byte(plaintext)), false)
+		_, err = automerge.LoadSyncMessage(e.Data)
+		assertEqual(t, err != nil, true)
+	}
+	assertEqual(t, encrypted > 0, true)
+}
+
+func TestServeChanges_encryption(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	keyring, err := NewKeyring("k1", map[string][]byte{"k1": bytes.Repeat([]byte{7}, 32)})
+	assertEqual(t, err, nil)
+
+	serverDoc := NewSharedDoc(automerge.New())
+	assertEqual(t, serverDoc.Doc().RootMap().Set("server", "server-secret"), nil)
+	_, _ = serverDoc.Doc().Commit("change")
+	serveErrs := make(chan error, 1)
+	url := startTestServer(t, &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveErrs <- serverDoc.ServeChanges(w, r, WithServerEncryption(keyring))
+	})})
+
+	clientDoc := NewSharedDoc(automerge.New())
+	assertEqual(t, clientDoc.Doc().RootMap().Set("client", "client-secret"), nil)
+	_, _ = clientDoc.Doc().Commit("change")
+	wire := new(wireCapture)
+	assertEqual(t, clientDoc.HttpPushPullChanges(ctx, url, WithHttpClient(wire), WithClientEncryption(keyring), WithClientTerminationCheck(HeadsEqualCheck)), nil)
+	assertEqual(t, <-serveErrs, nil)
+
+	assertEqual(t, clientDoc.Doc().Heads(), serverDoc.Doc().Heads())
+	values, _ := serverDoc.Doc().RootMap().Values()
+	assertEqual(t, values["client"].Str(), "client-secret")
+	values, _ = clientDoc.Doc().RootMap().Values()
+	assertEqual(t, values["server"].Str(), "server-secret")
+
+	wire.mutex.Lock()
+	defer wire.mutex.Unlock()
+	assertCiphertext(t, wire.sent.Bytes(), "client-secret")
+	assertCiphertext(t, wire.received.Bytes(), "server-secret")
+}
+
+func TestBlindRelay_rejects_plain_messages(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	relay := NewBlindRelay()
+	relayErrs := make(chan error, 2)
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /{id}", func(w http.ResponseWriter, r *http.Request) {
+		relayErrs <- relay.ServeRelay(w, r, r.PathValue("id"))
+	})
+	serverUrl := startTestServer(t, &http.Server{Handler: mux})
+
+	doc := NewSharedDoc(automerge.New())
+	assertEqual(t, doc.Doc().RootMap().Set("a", "b"), nil)
+	_, _ = doc.Doc().Commit("change")
+	keyring, _ := NewKeyring("k1", map[string][]byte{"k1": bytes.Repeat([]byte{7}, 16)})
+
+	wg := new(sync.WaitGroup)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_ = doc.HttpPushPullChanges(ctx, serverUrl+"/room")
+	}()
+	go func() {
+		defer wg.Done()
+		_ = NewSharedDoc(automerge.New()).HttpPushPullChanges(ctx, serverUrl+"/room", WithClientEncryption(keyring))
+	}()
+	wg.Wait()
+	assertErrorEqual(t, errors.Join(<-relayErrs, <-relayErrs), "message 1 is not encrypted")
+}
@@ -0,0 +1,144 @@
+package automergendjsonsync
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/automerge/automerge-go"
+)
+
+type replicationOptions struct {
+	clientOptions []ClientOption
+	minBackoff    time.Duration
+	maxBackoff    time.Duration
+	url           func(upstream string, id string) string
+}
+
+type ReplicationOption func(*replicationOptions)
+
+func newReplicationOptions(opts ...ReplicationOption) *replicationOptions {
+	options := &replicationOptions{
+		minBackoff: time.Second,
+		maxBackoff: time.Minute,
+		url: func(upstream string, id string) string {
+			return strings.TrimSuffix(upstream, "/") + "/" + url.PathEscape(id)
+		},
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
+
+// WithReplicationClientOptions sets the client options used for each outbound connection.
+func WithReplicationClientOptions(opts ...ClientOption) ReplicationOption {
+	return func(o *replicationOptions) {
+		o.clientOptions = append(o.clientOptions, opts...)
+	}
+}
+
+// WithReplicationBackoff sets the minimum and maximum delay before reconnecting after a connection ends. The delay
+// doubles after each consecutive failure.
+func WithReplicationBackoff(minBackoff, maxBackoff time.Duration) ReplicationOption {
+	return func(o *replicationOptions) {
+		o.minBackoff = minBackoff
+		o.maxBackoff = maxBackoff
+	}
+}
+
+// WithReplicationUrl sets the function that builds the url of a doc on an upstream server. By default, the escaped
+// doc id is appended to the upstream url as a path segment.
+func WithReplicationUrl(f func(upstream string, id string) string) ReplicationOption {
+	return func(o *replicationOptions) {
+		o.url = f
+	}
+}
+
+// Replicate keeps an outbound HttpPushPullChanges stream open to each of the upstream servers for every doc in the
+// repo. Docs added to the repo later are discovered and replicated too. Connections that end or fail are reconnected
+// after a backoff. This blocks until the context is cancelled and returns its error once every connection has ended.
+func (r *Repo) Replicate(ctx context.Context, upstreams []string, opts ...ReplicationOption) error {
+	log := Logger(ctx)
+	options := newReplicationOptions(opts...)
+
+	sub, fin := r.SubscribeToNewDocs()
+	defer fin()
+
+	wg := new(sync.WaitGroup)
+	defer wg.Wait()
+
+	replicating := make(map[string]bool)
+	for {
+		for _, id := range r.Ids() {
+			if replicating[id] {
+				continue
+			}
+			replicating[id] = true
+			doc, _ := r.Get(id)
+			for _, upstream := range upstreams {
+				target := options.url(upstream, id)
+				log.InfoContext(ctx, "starting replication", slog.String("id", id), slog.String("target", target))
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					replicateDoc(ctx, doc, target, options)
+				}()
+			}
+		}
+		select {
+		case <-sub:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// replicateDoc runs the connection for a single doc and upstream, reconnecting until the context is cancelled.
+func replicateDoc(ctx context.Context, doc *SharedDoc, target string, options *replicationOptions) {
+	log := Logger(ctx)
+	backoff := options.minBackoff
+	state := automerge.NewSyncState(doc.Doc())
+	for {
+		started := time.Now()
+		clientOpts := append([]ClientOption{WithClientTerminationCheck(NoTerminationCheck), WithClientSyncState(state)}, options.clientOptions...)
+		err := doc.HttpPushPullChanges(ctx, target, clientOpts...)
+		if ctx.Err() != nil {
+			return
+		}
+		// The next connection resumes from the heads that both sides are known to share rather than resyncing the
+		// whole history, but the messages that were in flight on this connection may have been lost.
+		state = resumeSyncState(doc, state)
+		// A connection that stayed up for a while was healthy, or was ended by the upstream draining, so we start
+		// backing off from the minimum again.
+		if time.Since(started) > options.maxBackoff || errors.Is(err, ErrPeerGoodbye) {
+			backoff = options.minBackoff
+		}
+		// A server that is busy or draining says how long to wait before retrying.
+		delay := backoff
+		if statusErr := new(HttpStatusError); errors.As(err, &statusErr) {
+			delay = max(delay, statusErr.RetryAfter)
+		}
+		log.WarnContext(ctx, "replication connection ended, reconnecting", slog.String("target", target), slog.Duration("backoff", delay), slog.Any("err", err))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(backoff*2, options.maxBackoff)
+	}
+}
+
+// resumeSyncState returns a sync state for a new connection that keeps what the peer was known to have from the state
+// of a connection that has ended, without what was in flight.
+func resumeSyncState(doc *SharedDoc, state *automerge.SyncState) *automerge.SyncState {
+	resumed, err := automerge.LoadSyncState(doc.Doc(), state.Save())
+	if err != nil {
+		return automerge.NewSyncState(doc.Doc())
+	}
+	return resumed
+}
@@ -0,0 +1,165 @@
+package automergendjsonsync
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/automerge/automerge-go"
+)
+
+func TestRepo_Replicate(t *testing.T) {
+	t.Parallel()
+
+	upstream := NewRepo()
+	requests := new(atomic.Int32)
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /{id}", func(w http.ResponseWriter, r *http.Request) {
+		// The first connection fails so that we can see the replication reconnect.
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_ = upstream.GetOrCreate(r.PathValue("id")).ServeChanges(w, r)
+	})
+	url := startTestServer(t, &http.Server{Handler: mux})
+
+	local := NewRepo()
+	x := local.GetOrCreate("x")
+	assertEqual(t, x.Doc().RootMap().Set("a", "b"), nil)
+	_, _ = x.Doc().Commit("change")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- local.Replicate(ctx, []string{url}, WithReplicationBackoff(time.Millisecond*10, time.Millisecond*100))
+	}()
+
+	// A doc added after replication started should be discovered.
+	y := local.GetOrCreate("y/z")
+	assertEqual(t, y.Doc().RootMap().Set("c", "d"), nil)
+	_, _ = y.Doc().Commit("change")
+	y.NotifyReceivedChanges()
+
+	for ctx.Err() == nil {
+		ux, okx := upstream.Get("x")
+		uy, oky := upstream.Get("y/z")
+		if okx && oky && slices.Equal(ux.Doc().Heads(), x.Doc().Heads()) && slices.Equal(uy.Doc().Heads(), y.Doc().Heads()) {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	assertEqual(t, ctx.Err(), nil)
+	assertEqual(t, requests.Load() >= 3, true)
+
+	cancel()
+	assertEqual(t, <-done, context.Canceled)
+}
+
+func TestRepo_Replicate_retry_after(t *testing.T) {
+	t.Parallel()
+
+	upstream := NewSharedDoc(automerge.New())
+	mutex := new(sync.Mutex)
+	times := make([]time.Time, 0)
+	url := startTestServer(t, &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		times = append(times, time.Now())
+		first := len(times) == 1
+		mutex.Unlock()
+		// The first connection is rejected with a delay which is much longer than the backoff.
+		if first {
+			writeServiceUnavailable(w, time.Second)
+			return
+		}
+		_ = upstream.ServeChanges(w, r)
+	})})
+
+	local := NewRepo()
+	x := local.GetOrCreate("x")
+	assertEqual(t, x.Doc().RootMap().Set("a", "b"), nil)
+	_, _ = x.Doc().Commit("change")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- local.Replicate(ctx, []string{url}, WithReplicationBackoff(time.Millisecond*10, time.Millisecond*100), WithReplicationUrl(func(upstream string, id string) string {
+			return upstream
+		}))
+	}()
+	for ctx.Err() == nil && !slices.Equal(upstream.Doc().Heads(), x.Doc().Heads()) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	cancel()
+	assertEqual(t, <-done, context.Canceled)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assertEqual(t, len(times) >= 2, true)
+	assertEqual(t, times[1].Sub(times[0]) >= time.Second, true)
+}
+
+func TestRepo_Replicate_resumes_sync_state(t *testing.T) {
+	t.Parallel()
+
+	upstream := NewSharedDoc(automerge.New())
+	// Each connection reports the heads that the first message it receives claims to have already synced.
+	firstLastSync := make(chan []automerge.ChangeHash, 10)
+	url := startTestServer(t, &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		first := true
+		_ = upstream.ServeChanges(w, r, WithLineReadPredicate(func(ctx context.Context, line *NdJson, doc *automerge.Doc, msg *automerge.SyncMessage) (bool, error) {
+			if first {
+				first = false
+				var lastSync []automerge.ChangeHash
+				if _, have, _, err := parseSyncMessageNeedHave(msg.Bytes()); err == nil {
+					for _, h := range have {
+						lastSync = append(lastSync, h.lastSync...)
+					}
+				}
+				firstLastSync <- lastSync
+			}
+			return true, nil
+		}))
+	})})
+
+	local := NewRepo()
+	x := local.GetOrCreate("x")
+	assertEqual(t, x.Doc().RootMap().Set("a", "b"), nil)
+	_, _ = x.Doc().Commit("change")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- local.Replicate(ctx, []string{url}, WithReplicationBackoff(time.Millisecond*10, time.Millisecond*100), WithReplicationUrl(func(upstream string, id string) string {
+			return upstream
+		}))
+	}()
+
+	// The first connection starts from nothing. Once a connection has synced, the connections after it are
+	// disconnected until one resumes from the synced heads rather than from the start of the history.
+	assertEqual(t, len(<-firstLastSync), 0)
+	for ctx.Err() == nil {
+		if slices.Equal(upstream.Doc().Heads(), x.Doc().Heads()) {
+			for _, s := range upstream.Sessions() {
+				upstream.DisconnectSession(s.Id)
+			}
+		}
+		select {
+		case lastSync := <-firstLastSync:
+			if slices.Equal(lastSync, x.Doc().Heads()) {
+				cancel()
+			}
+		case <-time.After(time.Millisecond * 10):
+		case <-ctx.Done():
+		}
+	}
+	assertEqual(t, <-done, context.Canceled)
+	assertEqual(t, context.Cause(ctx), context.Canceled)
+}
@@ -0,0 +1,84 @@
+package automergendjsonsync
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/automerge/automerge-go"
+)
+
+// Repo is a concurrency-safe set of SharedDocs identified by id, such as all the documents served by a server. Other
+// components like replication can subscribe to the repo in order to discover new documents as they are added.
+type Repo struct {
+	mutex    sync.Mutex
+	docs     map[string]*SharedDoc
+	channels []chan bool
+}
+
+// NewRepo returns a new empty Repo.
+func NewRepo() *Repo {
+	return &Repo{docs: make(map[string]*SharedDoc)}
+}
+
+// Get returns the doc with the given id if it exists.
+func (r *Repo) Get(id string) (*SharedDoc, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	doc, ok := r.docs[id]
+	return doc, ok
+}
+
+// GetOrCreate returns the doc with the given id, adding a new empty doc if it does not exist yet.
+func (r *Repo) GetOrCreate(id string) *SharedDoc {
+	doc, _ := r.LoadOrStore(id, NewSharedDoc(automerge.New()))
+	return doc
+}
+
+// LoadOrStore returns the existing doc with the given id if there is one. Otherwise, it adds the given doc and returns
+// it. The bool result is true if the doc was already present.
+func (r *Repo) LoadOrStore(id string, doc *SharedDoc) (*SharedDoc, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if existing, ok := r.docs[id]; ok {
+		return existing, true
+	}
+	r.docs[id] = doc
+	for _, channel := range r.channels {
+		select {
+		case channel <- true:
+		default:
+		}
+	}
+	return doc, false
+}
+
+// Ids returns the sorted ids of all the docs in the repo.
+func (r *Repo) Ids() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	ids := make([]string, 0, len(r.docs))
+	for id := range r.docs {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// SubscribeToNewDocs allows the caller to subscribe to docs being added to the repo. Like
+// SharedDoc.SubscribeToReceivedChanges the channel is a hint, so the caller should check Ids after receiving from it.
+// Call the finish function to clean up.
+func (r *Repo) SubscribeToNewDocs() (chan bool, func()) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	nc := make(chan bool, 1)
+	r.channels = append(r.channels, nc)
+	return nc, func() {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		if i := slices.Index(r.channels, nc); i >= 0 {
+			c := r.channels[i]
+			r.channels = slices.Delete(r.channels, i, i+1)
+			close(c)
+		}
+	}
+}
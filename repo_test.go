@@ -0,0 +1,38 @@
+package automergendjsonsync
+
+import (
+	"testing"
+
+	"github.com/automerge/automerge-go"
+)
+
+func TestRepo(t *testing.T) {
+	t.Parallel()
+	r := NewRepo()
+	sub, fin := r.SubscribeToNewDocs()
+
+	_, ok := r.Get("a")
+	assertEqual(t, ok, false)
+
+	a := r.GetOrCreate("a")
+	assertEqual(t, <-sub, true)
+	assertEqual(t, r.GetOrCreate("a"), a)
+
+	b := NewSharedDoc(automerge.New())
+	actual, loaded := r.LoadOrStore("b", b)
+	assertEqual(t, actual, b)
+	assertEqual(t, loaded, false)
+	assertEqual(t, <-sub, true)
+	actual, loaded = r.LoadOrStore("b", NewSharedDoc(automerge.New()))
+	assertEqual(t, actual, b)
+	assertEqual(t, loaded, true)
+
+	got, ok := r.Get("b")
+	assertEqual(t, got, b)
+	assertEqual(t, ok, true)
+	assertEqual(t, r.Ids(), []string{"a", "b"})
+
+	fin()
+	_, ok = <-sub
+	assertEqual(t, ok, false)
+}
@@ -5,9 +5,12 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
-	"mime"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/automerge/automerge-go"
 )
@@ -16,9 +19,16 @@ import (
 // been synced into the doc. This event is generally used to wake up other goroutines for generating sync messages to
 // other clients or servers but can also be used to driver other mechanisms like backups or transformers.
 type SharedDoc struct {
-	doc      *automerge.Doc
-	mutex    sync.Mutex
-	channels []chan bool
+	doc           *automerge.Doc
+	mutex         sync.Mutex
+	channels      []chan bool
+	sessions      map[string]*liveSession
+	lastSessionId uint64
+	draining      bool
+	// remoteHeadsChanged is closed and replaced whenever a session records new remote heads or ends.
+	remoteHeadsChanged chan struct{}
+	// persistedHeads are the heads last reported to MarkPersisted.
+	persistedHeads []automerge.ChangeHash
 }
 
 // NewSharedDoc returns a new SharedDoc
@@ -32,10 +42,25 @@ func (b *SharedDoc) Doc() *automerge.Doc {
 }
 
 type serverOptions struct {
-	state            *automerge.SyncState
-	headerEditors    []func(rw http.Header)
-	readPredicate    ReadPredicate
-	terminationCheck TerminationCheck
+	state             *automerge.SyncState
+	headerEditors     []func(rw http.Header)
+	readPredicate     ReadPredicate
+	terminationCheck  TerminationCheck
+	recorder          Recorder
+	keyring           *Keyring
+	signer            *Signer
+	linePredicates    []LineReadPredicate
+	identityExtractor IdentityExtractor
+	// connectionRateLimit is applied to each request on its own.
+	connectionRateLimit *RateLimit
+	// identityRateLimiter is shared between the requests of each identity.
+	identityRateLimiter *IdentityRateLimiter
+	maxDocSessions      int
+	sessionLimiter      *SessionLimiter
+	retryAfter          time.Duration
+	timeouts            sessionTimeouts
+	progress            func(progress SyncProgress)
+	hooks               *SessionHooks
 }
 
 type ServerOption func(*serverOptions)
@@ -44,6 +69,7 @@ func newServerOptions(opts ...ServerOption) *serverOptions {
 	options := &serverOptions{
 		readPredicate:    NoReadPredicate,
 		terminationCheck: NoTerminationCheck,
+		retryAfter:       5 * time.Second,
 	}
 	for _, opt := range opts {
 		opt(options)
@@ -69,15 +95,40 @@ func WithReadPredicate(f ReadPredicate) ServerOption {
 	}
 }
 
+// WithLineReadPredicate adds a LineReadPredicate which must include each message, along with the ReadPredicate, for
+// the message to be received. This can be used more than once.
+func WithLineReadPredicate(f LineReadPredicate) ServerOption {
+	return func(o *serverOptions) {
+		o.linePredicates = append(o.linePredicates, f)
+	}
+}
+
 func WithTerminationCheck(f TerminationCheck) ServerOption {
 	return func(o *serverOptions) {
 		o.terminationCheck = f
 	}
 }
 
-func isNotSuitableContentType(in string) bool {
-	mt, p, err := mime.ParseMediaType(in)
-	return err != nil || mt != ContentType || (p["charset"] != "" && p["charset"] != "utf-8")
+// WithServerRecorder passes every message read from the request and written to the response to the recorder.
+func WithServerRecorder(recorder Recorder) ServerOption {
+	return func(o *serverOptions) {
+		o.recorder = recorder
+	}
+}
+
+// WithServerEncryption encrypts and decrypts the data of every message with the keys in the keyring. Use this on
+// a server that is trusted with the document content; see BlindRelay for servers that aren't.
+func WithServerEncryption(keyring *Keyring) ServerOption {
+	return func(o *serverOptions) {
+		o.keyring = keyring
+	}
+}
+
+// WithServerSigner signs the data of every message written to the response.
+func WithServerSigner(signer *Signer) ServerOption {
+	return func(o *serverOptions) {
+		o.signer = signer
+	}
 }
 
 func (b *SharedDoc) ServeChanges(rw http.ResponseWriter, req *http.Request, opts ...ServerOption) (finalErr error) {
@@ -87,30 +138,145 @@ func (b *SharedDoc) ServeChanges(rw http.ResponseWriter, req *http.Request, opts
 		options.state = automerge.NewSyncState(b.Doc())
 	}
 
-	// If there is an accept header, then ensure it's compatible.
-	if v := req.Header.Get("Accept"); v != "" && isNotSuitableContentType(v) {
-		rw.WriteHeader(http.StatusNotAcceptable)
+	requestContentType, responseContentType, ok := negotiateContentTypes(rw, req)
+	if !ok {
 		return nil
 	}
-	// If there is a content-type header, then ensure it's what we expect
-	if v := req.Header.Get("Content-Type"); v != "" && isNotSuitableContentType(v) {
-		rw.WriteHeader(http.StatusUnsupportedMediaType)
+	ctx := req.Context()
+	if options.identityExtractor != nil {
+		identity, err := options.identityExtractor(req)
+		if err != nil {
+			log.InfoContext(ctx, "rejecting request without identity", slog.Any("err", err))
+			rw.WriteHeader(http.StatusForbidden)
+			return nil
+		}
+		ctx = SetContextIdentity(ctx, identity)
+	}
+	var rateLimiters []*rateLimiter
+	if options.connectionRateLimit != nil {
+		rateLimiters = append(rateLimiters, newRateLimiter("connection", *options.connectionRateLimit, time.Now()))
+	}
+	identity, hasIdentity := ContextIdentity(ctx)
+	if hasIdentity && options.identityRateLimiter != nil {
+		limiter, release := options.identityRateLimiter.acquire(identity, time.Now())
+		defer release()
+		rateLimiters = append(rateLimiters, limiter)
+	}
+	// Limits are checked before the response is started so that a client that expects 100-continue never sends the
+	// body of a rejected request.
+	if options.sessionLimiter != nil {
+		if !options.sessionLimiter.acquire() {
+			log.InfoContext(ctx, "rejecting request over the session limit")
+			writeServiceUnavailable(rw, options.retryAfter)
+			return nil
+		}
+		defer options.sessionLimiter.release()
+	}
+	ctx, session, finish, err := b.startSession(ctx, SessionInfo{Role: SessionServer, PeerId: identity, RemoteAddr: req.RemoteAddr, Protocol: req.Proto}, options.state, options.maxDocSessions)
+	if err != nil {
+		log.InfoContext(ctx, "rejecting request", slog.Any("err", err))
+		writeServiceUnavailable(rw, options.retryAfter)
+		return nil
+	}
+	defer finish()
+	hooks := newHookRunner(options.hooks, session, b.doc)
+	defer func() {
+		hooks.disconnect(context.WithoutCancel(ctx), finalErr)
+	}()
+	go session.watch(ctx, options.timeouts)
+	// Closing the request body doesn't interrupt a read that is already blocked, so a disconnect also expires the read
+	// deadline of the connection.
+	stop := context.AfterFunc(ctx, func() {
+		if errors.Is(context.Cause(ctx), ErrSessionDisconnected) {
+			_ = http.NewResponseController(rw).SetReadDeadline(time.Now())
+		}
+	})
+	defer stop()
+	startSyncResponse(rw, req, responseContentType, options.headerEditors)
+	hooks.connect(ctx, req)
+
+	// Unlike the client, the server keeps writing messages after the request body has finished until the client
+	// disconnects, since the client may still be reading the response.
+	err = b.SyncOverStream(ctx, req.Body, rw, func(o *streamOptions) {
+		o.state = options.state
+		o.readPredicate = options.readPredicate
+		o.terminationCheck = options.terminationCheck
+		o.readContentType = requestContentType
+		o.writeContentType = responseContentType
+		o.recorder = options.recorder
+		o.keyring = options.keyring
+		o.signer = options.signer
+		o.linePredicates = options.linePredicates
+		o.rateLimiters = rateLimiters
+		o.session = session
+		o.progress = options.progress
+		o.hooks = hooks
+		o.sendAcks = true
+		// It's bad if the request reached EOF without any sync messages since our writer can't really do anything
+		// in response.
+		o.noMessagesErr = fmt.Errorf("request closed with no messages received")
+		o.writeUntilDone = true
+	})
+	// If the request context is closed (indicating that the client disconnected), or the body was closed by the http
+	// server, then this isn't really an error.
+	if req.Context().Err() != nil {
+		log.DebugContext(ctx, "client context closed")
+		return nil
+	} else if errors.Is(context.Cause(ctx), ErrSessionDisconnected) {
+		log.InfoContext(ctx, "session disconnected", slog.Any("cause", context.Cause(ctx)))
+		return nil
+	} else if errors.Is(err, ErrPeerGoodbye) {
+		log.DebugContext(ctx, "client said goodbye")
+		return nil
+	} else if errors.Is(err, http.ErrBodyReadAfterClose) {
+		log.DebugContext(ctx, "read after close")
 		return nil
 	}
+	return err
+}
 
-	ctx := req.Context()
+// negotiateContentTypes picks the formats of the request and response bodies of a sync request. If the request is not
+// acceptable, the error status is written and false is returned.
+func negotiateContentTypes(rw http.ResponseWriter, req *http.Request) (string, string, bool) {
+	// If there is a content-type header, then ensure it's what we expect
+	requestContentType, ok := ContentType, true
+	if v := req.Header.Get("Content-Type"); v != "" {
+		if requestContentType, ok = suitableContentType(v); !ok {
+			rw.WriteHeader(http.StatusUnsupportedMediaType)
+			return "", "", false
+		}
+	}
+	// If there is an accept header, then ensure it's compatible and pick the format of the response from it. Otherwise,
+	// or for wildcards, respond in the same format as the request.
+	responseContentType := requestContentType
+	if v := strings.Join(req.Header.Values("Accept"), ","); v != "" {
+		if responseContentType, ok = negotiateContentType(v, requestContentType); !ok {
+			rw.WriteHeader(http.StatusNotAcceptable)
+			return "", "", false
+		}
+	}
+	return requestContentType, responseContentType, true
+}
 
+// writeServiceUnavailable rejects a request that may be retried after the given delay.
+func writeServiceUnavailable(rw http.ResponseWriter, retryAfter time.Duration) {
+	rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	rw.WriteHeader(http.StatusServiceUnavailable)
+}
+
+// startSyncResponse writes and flushes the headers of a successful sync response.
+func startSyncResponse(rw http.ResponseWriter, req *http.Request, contentType string, headerEditors []func(headers http.Header)) {
 	// Because the request body is relatively expensive to produce, the client may only want to produce it when the request has been accepted.
 	// So it may send an Expect=100-continue header and expect us to honor it.
 	if req.Header.Get("Expect") == "100-continue" {
 		rw.WriteHeader(http.StatusContinue)
 	}
 
-	log.InfoContext(ctx, "sending http sync response", slog.String("proto", req.Proto), slog.String("target", fmt.Sprintf("%s %s", req.Method, req.URL)), slog.Int("status", http.StatusOK))
-	rw.Header().Set("Content-Type", ContentTypeWithCharset)
+	Logger(req.Context()).InfoContext(req.Context(), "sending http sync response", slog.String("proto", req.Proto), slog.String("target", fmt.Sprintf("%s %s", req.Method, req.URL)), slog.Int("status", http.StatusOK))
+	rw.Header().Set("Content-Type", contentTypeHeader(contentType))
 	rw.Header().Set("X-Content-Type-Options", "nosniff")
 	rw.Header().Set("Cache-Control", "no-store")
-	for _, he := range options.headerEditors {
+	for _, he := range headerEditors {
 		he(rw.Header())
 	}
 	rw.WriteHeader(http.StatusOK)
@@ -119,50 +285,4 @@ func (b *SharedDoc) ServeChanges(rw http.ResponseWriter, req *http.Request, opts
 	if v, ok := rw.(http.Flusher); ok {
 		v.Flush()
 	}
-
-	// We produce the messages in a goroutine which must be shut down on exit.
-	wg := new(sync.WaitGroup)
-	defer wg.Wait()
-
-	sub, fin := b.SubscribeToReceivedChanges()
-	defer fin()
-
-	// We piggyback on the context and ensure we cancel it before waiting for the wait group.
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-
-	log.DebugContext(ctx, "starting to read messages from request body in the background")
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		if received, err := b.consumeMessagesFromReader(ctx, options.state, req.Body, options.readPredicate, options.terminationCheck); err != nil {
-			// If we've finished and the request context is closed (indicating that the client disconnected), then this
-			// isn't really an error. For anything else, set the final error and cancel the context. The cancellation
-			// should stop the writer from producing messages and lead to closing the response.
-			if req.Context().Err() != nil {
-				log.DebugContext(ctx, "client context closed")
-			} else if errors.Is(err, http.ErrBodyReadAfterClose) {
-				log.DebugContext(ctx, "read after close")
-			} else {
-				finalErr = err
-				cancel()
-			}
-		} else if received == 0 {
-			// It's bad if the request reached EOF without any sync messages since our writer can't really do anything
-			// in response. So we set an error and cancel.
-			finalErr = fmt.Errorf("request closed with no messages received")
-			cancel()
-		}
-	}()
-
-	log.DebugContext(ctx, "writing messages to response body")
-	if err := generateMessagesToWriter(ctx, options.state, sub, rw, false); err != nil {
-		// If we close and the request context is closed then there's no particular error unless finalErr has been set
-		// from the reading routine.
-		if ctx.Err() != nil {
-			return
-		}
-		return errors.Join(err, finalErr)
-	}
-	return
 }
@@ -84,3 +84,47 @@ func TestServe_exchange(t *testing.T) {
 	lines := strings.Split(strings.TrimSpace(rw.Body.String()), "\n")
 	assertEqual(t, len(lines), 2)
 }
+
+func TestServe_content_negotiation(t *testing.T) {
+	t.Parallel()
+
+	t.Run("unsupported content type", func(t *testing.T) {
+		sd := NewSharedDoc(automerge.New())
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPut, "/", nil)
+		req.Header.Set("Content-Type", "text/plain")
+		assertEqual(t, sd.ServeChanges(rw, req), nil)
+		assertEqual(t, rw.Result().StatusCode, http.StatusUnsupportedMediaType)
+	})
+
+	t.Run("unacceptable content type", func(t *testing.T) {
+		sd := NewSharedDoc(automerge.New())
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPut, "/", nil)
+		req.Header.Set("Accept", "text/plain")
+		assertEqual(t, sd.ServeChanges(rw, req), nil)
+		assertEqual(t, rw.Result().StatusCode, http.StatusNotAcceptable)
+	})
+
+	t.Run("binary response", func(t *testing.T) {
+		sd := NewSharedDoc(automerge.New())
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPut, "/", nil)
+		req.Header.Set("Accept", ContentTypeBinary)
+		assertErrorEqual(t, sd.ServeChanges(rw, req), "request closed with no messages received")
+		assertEqual(t, rw.Result().StatusCode, http.StatusOK)
+		assertEqual(t, rw.Result().Header.Get("Content-Type"), ContentTypeBinary)
+		assertEqual(t, rw.Body.Bytes(), []byte{10, binaryEventSync, binaryFieldData, 7, 0x42, 0, 0, 1, 0, 0, 0})
+	})
+
+	t.Run("binary request with wildcard accept", func(t *testing.T) {
+		sd := NewSharedDoc(automerge.New())
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPut, "/", nil)
+		req.Header.Set("Content-Type", ContentTypeBinary)
+		req.Header.Set("Accept", "*/*")
+		assertErrorEqual(t, sd.ServeChanges(rw, req), "request closed with no messages received")
+		assertEqual(t, rw.Result().StatusCode, http.StatusOK)
+		assertEqual(t, rw.Result().Header.Get("Content-Type"), ContentTypeBinary)
+	})
+}
@@ -0,0 +1,298 @@
+package automergendjsonsync
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/automerge/automerge-go"
+)
+
+// ErrSessionDisconnected is returned by HttpPushPullChanges when its session was ended by DisconnectSession. Other
+// causes of a disconnect, such as ErrSessionTimeout, wrap it.
+var ErrSessionDisconnected = errors.New("session disconnected")
+
+// SessionRole is which end of the sync a session is on.
+type SessionRole string
+
+const (
+	SessionServer SessionRole = "server"
+	SessionClient SessionRole = "client"
+)
+
+// SessionInfo is a snapshot of an active sync session on a SharedDoc.
+type SessionInfo struct {
+	// Id identifies the session within the SharedDoc, for use with DisconnectSession.
+	Id   string      `json:"id"`
+	Role SessionRole `json:"role"`
+	// PeerId is the identity of the peer if known. For servers this is the identity on the request context, see
+	// WithServerIdentity, and for clients this is the common name of the server certificate.
+	PeerId string `json:"peer_id,omitempty"`
+	// RemoteAddr is the address of the client for servers, and the url of the server for clients.
+	RemoteAddr string `json:"remote_addr"`
+	// Protocol is the http protocol of the session, which for clients is only known once the response has arrived.
+	Protocol         string    `json:"protocol,omitempty"`
+	StartedAt        time.Time `json:"started_at"`
+	LastActivity     time.Time `json:"last_activity"`
+	ReceivedMessages int       `json:"received_messages"`
+	ReceivedBytes    int       `json:"received_bytes"`
+	SentMessages     int       `json:"sent_messages"`
+	SentBytes        int       `json:"sent_bytes"`
+}
+
+type liveSession struct {
+	mutex  sync.Mutex
+	info   SessionInfo
+	cancel context.CancelCauseFunc
+	// state is the sync state used with the peer.
+	state *automerge.SyncState
+	// remoteHeads are the heads that the peer has advertised, see recordRemoteHeads.
+	remoteHeads []automerge.ChangeHash
+	// persistedHeads are the heads of the last EventAck from the peer.
+	persistedHeads []automerge.ChangeHash
+	// drain is closed to ask the session to flush its messages and say goodbye.
+	drain     chan struct{}
+	drainOnce sync.Once
+	// done is closed once the session has finished.
+	done chan struct{}
+}
+
+func (s *liveSession) startDrain() {
+	s.drainOnce.Do(func() {
+		close(s.drain)
+	})
+}
+
+func (s *liveSession) update(f func(info *SessionInfo)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f(&s.info)
+}
+
+func (s *liveSession) snapshot() SessionInfo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.info
+}
+
+var (
+	errDocDraining     = errors.New("the doc is draining")
+	errTooManySessions = errors.New("the doc has too many sessions")
+)
+
+// startSession registers a session that syncs with the given state, and returns a context which is cancelled if the
+// session is disconnected, along with a function to unregister it once it has finished. No session is started if the
+// doc is draining, or if there are already maxSessions sessions with the same role, unless maxSessions is 0.
+func (b *SharedDoc) startSession(ctx context.Context, info SessionInfo, state *automerge.SyncState, maxSessions int) (context.Context, *liveSession, func(), error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.draining {
+		return ctx, nil, nil, errDocDraining
+	}
+	if maxSessions > 0 {
+		active := 0
+		for _, s := range b.sessions {
+			if s.info.Role == info.Role {
+				active++
+			}
+		}
+		if active >= maxSessions {
+			return ctx, nil, nil, errTooManySessions
+		}
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	b.lastSessionId++
+	info.Id = strconv.FormatUint(b.lastSessionId, 10)
+	info.StartedAt = time.Now()
+	info.LastActivity = info.StartedAt
+	s := &liveSession{info: info, cancel: cancel, state: state, drain: make(chan struct{}), done: make(chan struct{})}
+	if b.sessions == nil {
+		b.sessions = make(map[string]*liveSession)
+	}
+	b.sessions[info.Id] = s
+	return ctx, s, func() {
+		cancel(nil)
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		delete(b.sessions, info.Id)
+		b.notifyRemoteHeadsChanged()
+		close(s.done)
+	}, nil
+}
+
+// Sessions returns a snapshot of the active ServeChanges and HttpPushPullChanges sessions, in the order they started.
+func (b *SharedDoc) Sessions() []SessionInfo {
+	sessions := b.liveSessions()
+	out := make([]SessionInfo, 0, len(sessions))
+	for _, s := range sessions {
+		out = append(out, s.snapshot())
+	}
+	// Ids are allocated in order, so they sort sessions by when they started.
+	slices.SortFunc(out, func(a, b SessionInfo) int {
+		ai, _ := strconv.ParseUint(a.Id, 10, 64)
+		bi, _ := strconv.ParseUint(b.Id, 10, 64)
+		return cmp.Compare(ai, bi)
+	})
+	return out
+}
+
+func (b *SharedDoc) liveSessions() []*liveSession {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	sessions := make([]*liveSession, 0, len(b.sessions))
+	for _, s := range b.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// DisconnectSession ends the session with the given id, returning false if there is no such session. A server
+// session ends the response, while a client session ends the request and returns ErrSessionDisconnected.
+func (b *SharedDoc) DisconnectSession(id string) bool {
+	b.mutex.Lock()
+	s, ok := b.sessions[id]
+	b.mutex.Unlock()
+	if ok {
+		s.cancel(ErrSessionDisconnected)
+	}
+	return ok
+}
+
+// SessionLimiter caps the number of concurrent ServeChanges sessions across every doc that it is used with. Pass the
+// same SessionLimiter to every ServeChanges call with WithSessionLimiter.
+type SessionLimiter struct {
+	mutex  sync.Mutex
+	max    int
+	active int
+}
+
+// NewSessionLimiter returns a SessionLimiter that allows up to max concurrent sessions.
+func NewSessionLimiter(max int) *SessionLimiter {
+	return &SessionLimiter{max: max}
+}
+
+func (l *SessionLimiter) acquire() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.active >= l.max {
+		return false
+	}
+	l.active++
+	return true
+}
+
+func (l *SessionLimiter) release() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.active--
+}
+
+// WithMaxDocSessions limits the number of concurrent ServeChanges sessions on the doc. Requests over the limit are
+// rejected with a 503 Service Unavailable and a Retry-After header, before the request body is read.
+func WithMaxDocSessions(max int) ServerOption {
+	return func(o *serverOptions) {
+		o.maxDocSessions = max
+	}
+}
+
+// WithSessionLimiter limits the number of concurrent ServeChanges sessions across all the docs that share the
+// limiter. Requests over the limit are rejected in the same way as WithMaxDocSessions.
+func WithSessionLimiter(limiter *SessionLimiter) ServerOption {
+	return func(o *serverOptions) {
+		o.sessionLimiter = limiter
+	}
+}
+
+// WithServerRetryAfter sets the delay that clients are asked to wait, with the Retry-After header, before retrying a
+// request that was rejected because of a session limit or because the doc is draining. The default is 5 seconds.
+func WithServerRetryAfter(d time.Duration) ServerOption {
+	return func(o *serverOptions) {
+		o.retryAfter = d
+	}
+}
+
+// SessionsHandler returns an http.Handler for administering the sessions of the doc. A GET responds with the sessions
+// as json, and a DELETE with an id query parameter disconnects that session. The handler has no authentication of
+// its own, so it must only be served behind whatever protects the other admin endpoints.
+func (b *SharedDoc) SessionsHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+			rw.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(rw).Encode(struct {
+				Sessions []SessionInfo `json:"sessions"`
+			}{b.Sessions()})
+		case http.MethodDelete:
+			if id := req.URL.Query().Get("id"); id == "" {
+				http.Error(rw, "missing id query parameter", http.StatusBadRequest)
+			} else if !b.DisconnectSession(id) {
+				http.Error(rw, "session not found", http.StatusNotFound)
+			} else {
+				rw.WriteHeader(http.StatusNoContent)
+			}
+		default:
+			rw.Header().Set("Allow", "GET, DELETE")
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+type sessionReader struct {
+	reader  messageReader
+	session *liveSession
+}
+
+func (r *sessionReader) ReadMessage() (*NdJson, int, error) {
+	e, n, err := r.reader.ReadMessage()
+	if err == nil {
+		r.session.update(func(info *SessionInfo) {
+			info.ReceivedMessages++
+			info.ReceivedBytes += n
+			info.LastActivity = time.Now()
+		})
+	}
+	return e, n, err
+}
+
+type sessionWriter struct {
+	writer  messageWriter
+	session *liveSession
+}
+
+func (w *sessionWriter) WriteMessage(e *NdJson) (int, error) {
+	n, err := w.writer.WriteMessage(e)
+	if err == nil {
+		w.session.update(func(info *SessionInfo) {
+			info.SentMessages++
+			info.SentBytes += n
+			info.LastActivity = time.Now()
+		})
+	}
+	return n, err
+}
+
+func (w *sessionWriter) Close() error {
+	return closeWriter(w.writer)
+}
+
+// sessionTrackReader wraps the reader so that received messages are counted on the session, if there is one.
+func sessionTrackReader(session *liveSession, reader messageReader) messageReader {
+	if session == nil {
+		return reader
+	}
+	return &sessionReader{reader: reader, session: session}
+}
+
+// sessionTrackWriter wraps the writer so that sent messages are counted on the session, if there is one.
+func sessionTrackWriter(session *liveSession, writer messageWriter) messageWriter {
+	if session == nil {
+		return writer
+	}
+	return &sessionWriter{writer: writer, session: session}
+}
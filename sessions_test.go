@@ -0,0 +1,188 @@
+package automergendjsonsync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/automerge/automerge-go"
+)
+
+// waitForSession polls the doc until it has a session that has both sent and received a message.
+func waitForSession(t *testing.T, sd *SharedDoc) SessionInfo {
+	t.Helper()
+	for i := 0; i < 1000; i++ {
+		if sessions := sd.Sessions(); len(sessions) == 1 && sessions[0].ReceivedMessages > 0 && sessions[0].SentMessages > 0 {
+			return sessions[0]
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatal("timed out waiting for session")
+	return SessionInfo{}
+}
+
+func TestSessions(t *testing.T) {
+	t.Parallel()
+
+	serverDoc := NewSharedDoc(automerge.New())
+	assertEqual(t, serverDoc.Doc().RootMap().Set("a", "b"), nil)
+	_, _ = serverDoc.Doc().Commit("change")
+	serveErrs := make(chan error, 1)
+	url := startTestServer(t, &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveErrs <- serverDoc.ServeChanges(w, r.WithContext(SetContextIdentity(r.Context(), "alice")))
+	})})
+
+	t.Run("server disconnect", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+		clientDoc := NewSharedDoc(automerge.New())
+		clientErrs := make(chan error, 1)
+		go func() {
+			clientErrs <- clientDoc.HttpPushPullChanges(ctx, url)
+		}()
+
+		info := waitForSession(t, serverDoc)
+		assertEqual(t, info.Role, SessionServer)
+		assertEqual(t, info.PeerId, "alice")
+		assertEqual(t, info.Protocol, "HTTP/1.1")
+		assertEqual(t, info.RemoteAddr != "", true)
+		assertEqual(t, info.ReceivedBytes > 0 && info.SentBytes > 0, true)
+		clientInfo := waitForSession(t, clientDoc)
+		assertEqual(t, clientInfo.Role, SessionClient)
+		assertEqual(t, clientInfo.RemoteAddr, url)
+		assertEqual(t, clientInfo.Protocol, "HTTP/1.1")
+
+		rw := httptest.NewRecorder()
+		serverDoc.SessionsHandler().ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+		assertEqual(t, rw.Code, http.StatusOK)
+		var listed struct {
+			Sessions []SessionInfo `json:"sessions"`
+		}
+		assertEqual(t, json.Unmarshal(rw.Body.Bytes(), &listed), nil)
+		assertEqual(t, len(listed.Sessions), 1)
+		assertEqual(t, listed.Sessions[0].Id, info.Id)
+
+		rw = httptest.NewRecorder()
+		serverDoc.SessionsHandler().ServeHTTP(rw, httptest.NewRequest(http.MethodDelete, "/?id="+info.Id, nil))
+		assertEqual(t, rw.Code, http.StatusNoContent)
+		// the server ends the response, so the client finishes cleanly
+		assertEqual(t, <-serveErrs, nil)
+		assertEqual(t, <-clientErrs, nil)
+		assertEqual(t, len(serverDoc.Sessions()), 0)
+		assertEqual(t, len(clientDoc.Sessions()), 0)
+
+		rw = httptest.NewRecorder()
+		serverDoc.SessionsHandler().ServeHTTP(rw, httptest.NewRequest(http.MethodDelete, "/?id="+info.Id, nil))
+		assertEqual(t, rw.Code, http.StatusNotFound)
+	})
+
+	t.Run("client disconnect", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+		clientDoc := NewSharedDoc(automerge.New())
+		clientErrs := make(chan error, 1)
+		go func() {
+			clientErrs <- clientDoc.HttpPushPullChanges(ctx, url)
+		}()
+
+		info := waitForSession(t, clientDoc)
+		assertEqual(t, clientDoc.DisconnectSession(info.Id), true)
+		assertEqual(t, errors.Is(<-clientErrs, ErrSessionDisconnected), true)
+		assertEqual(t, <-serveErrs, nil)
+		assertEqual(t, len(clientDoc.Sessions()), 0)
+	})
+}
+
+func TestSessionLimits(t *testing.T) {
+	t.Parallel()
+
+	limiter := NewSessionLimiter(2)
+	serverDocs := []*SharedDoc{NewSharedDoc(automerge.New()), NewSharedDoc(automerge.New())}
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /{id}", func(w http.ResponseWriter, r *http.Request) {
+		doc := serverDocs[0]
+		if r.PathValue("id") == "1" {
+			doc = serverDocs[1]
+		}
+		_ = doc.ServeChanges(w, r, WithMaxDocSessions(1), WithSessionLimiter(limiter), WithServerRetryAfter(2*time.Second))
+	})
+	url := startTestServer(t, &http.Server{Handler: mux})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	follow := func(id string) (context.CancelFunc, chan error) {
+		ctx, cancel := context.WithCancel(ctx)
+		errs := make(chan error, 1)
+		go func() {
+			errs <- NewSharedDoc(automerge.New()).HttpPushPullChanges(ctx, url+"/"+id)
+		}()
+		return cancel, errs
+	}
+	// rejected checks that a request is rejected without its body ever being read
+	rejected := func(id string) {
+		t.Helper()
+		read := new(atomic.Bool)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPut, url+"/"+id, readerFunc(func(p []byte) (int, error) {
+			read.Store(true)
+			return 0, io.EOF
+		}))
+		req.Header.Set("Expect", "100-continue")
+		res, err := http.DefaultClient.Do(req)
+		assertEqual(t, err, nil)
+		_ = res.Body.Close()
+		assertEqual(t, res.StatusCode, http.StatusServiceUnavailable)
+		assertEqual(t, res.Header.Get("Retry-After"), "2")
+		assertEqual(t, read.Load(), false)
+	}
+
+	stop0, errs0 := follow("0")
+	waitForSession(t, serverDocs[0])
+	// the doc limit is reached but not the server limit
+	rejected("0")
+	err := NewSharedDoc(automerge.New()).HttpPushPullChanges(ctx, url+"/0")
+	statusErr := new(HttpStatusError)
+	assertEqual(t, errors.As(err, &statusErr), true)
+	assertEqual(t, *statusErr, HttpStatusError{StatusCode: http.StatusServiceUnavailable, RetryAfter: 2 * time.Second})
+
+	stop1, errs1 := follow("1")
+	waitForSession(t, serverDocs[1])
+	// now the server limit is reached too
+	rejected("1")
+
+	stop0()
+	assertEqual(t, errors.Is(<-errs0, context.Canceled), true)
+	for len(serverDocs[0].Sessions()) > 0 {
+		time.Sleep(time.Millisecond * 10)
+	}
+	stop1()
+	assertEqual(t, errors.Is(<-errs1, context.Canceled), true)
+	for len(serverDocs[1].Sessions()) > 0 {
+		time.Sleep(time.Millisecond * 10)
+	}
+	// the limiter is released once the handlers return
+	assertEqual(t, limiter.acquire(), true)
+	limiter.release()
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	assertEqual(t, parseRetryAfter("", now), time.Duration(0))
+	assertEqual(t, parseRetryAfter("120", now), 2*time.Minute)
+	assertEqual(t, parseRetryAfter("-1", now), time.Duration(0))
+	assertEqual(t, parseRetryAfter(now.Add(time.Minute).Format(http.TimeFormat), now), time.Minute)
+	assertEqual(t, parseRetryAfter(now.Add(-time.Minute).Format(http.TimeFormat), now), time.Duration(0))
+	assertEqual(t, parseRetryAfter("soon", now), time.Duration(0))
+}
@@ -0,0 +1,78 @@
+package automergendjsonsync
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+
+	"github.com/automerge/automerge-go"
+)
+
+// Signer signs the data of each message written by a peer with an ed25519 key, so that the receiver can prove which
+// peer sent the changes in each message. The id is sent along with the signature so the receiver can find the
+// matching public key.
+type Signer struct {
+	id  string
+	key ed25519.PrivateKey
+}
+
+// NewSigner returns a Signer that signs with the given private key under the given id.
+func NewSigner(id string, key ed25519.PrivateKey) *Signer {
+	return &Signer{id: id, key: key}
+}
+
+// signedBytes is the content covered by a signature. The prefix keeps these signatures from being valid in any
+// other context where the same key is used.
+func signedBytes(e *NdJson) []byte {
+	return append([]byte("automerge-ndjson-sync\x00"+e.Event+"\x00"), e.Data...)
+}
+
+// sign returns a copy of the message with the signature fields set. Messages without data are returned as is.
+func (s *Signer) sign(e *NdJson) *NdJson {
+	if len(e.Data) == 0 {
+		return e
+	}
+	out := *e
+	out.Signature, out.SignerId = ed25519.Sign(s.key, signedBytes(e)), s.id
+	return &out
+}
+
+type signingWriter struct {
+	writer messageWriter
+	signer *Signer
+}
+
+func (w *signingWriter) WriteMessage(e *NdJson) (int, error) {
+	return w.writer.WriteMessage(w.signer.sign(e))
+}
+
+func (w *signingWriter) Close() error {
+	return closeWriter(w.writer)
+}
+
+// signWriter wraps the writer so that each message is signed by the signer, if there is one.
+func signWriter(signer *Signer, writer messageWriter) messageWriter {
+	if signer == nil {
+		return writer
+	}
+	return &signingWriter{writer: writer, signer: signer}
+}
+
+// VerifySignaturesReadPredicate returns a LineReadPredicate which aborts the sync on any sync message that is not
+// signed by one of the given public keys, keyed by signer id. This runs before the message is received, so unsigned
+// or forged changes never reach the doc. The signature proves which peer sent the message, which is not necessarily
+// the peer that authored each change in it if that peer relays changes from others.
+func VerifySignaturesReadPredicate(keys map[string]ed25519.PublicKey) LineReadPredicate {
+	return func(ctx context.Context, line *NdJson, doc *automerge.Doc, msg *automerge.SyncMessage) (bool, error) {
+		if len(line.Signature) == 0 {
+			return false, fmt.Errorf("message is not signed")
+		}
+		key, ok := keys[line.SignerId]
+		if !ok {
+			return false, fmt.Errorf("unknown signer '%s'", line.SignerId)
+		} else if !ed25519.Verify(key, signedBytes(line), line.Signature) {
+			return false, fmt.Errorf("invalid signature from signer '%s'", line.SignerId)
+		}
+		return true, nil
+	}
+}
@@ -0,0 +1,58 @@
+package automergendjsonsync
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/automerge/automerge-go"
+)
+
+func TestSigning(t *testing.T) {
+	t.Parallel()
+	publicA, privateA, _ := ed25519.GenerateKey(nil)
+	publicB, privateB, _ := ed25519.GenerateKey(nil)
+	_, forged, _ := ed25519.GenerateKey(nil)
+	keys := map[string]ed25519.PublicKey{"a": publicA, "b": publicB}
+	keyring, _ := NewKeyring("k", map[string][]byte{"k": bytes.Repeat([]byte{1}, 16)})
+
+	newDocs := func() (*SharedDoc, *SharedDoc) {
+		a, b := NewSharedDoc(automerge.New()), NewSharedDoc(automerge.New())
+		assertEqual(t, a.Doc().RootMap().Set("a", int64(1)), nil)
+		_, _ = a.Doc().Commit("change")
+		return a, b
+	}
+
+	for _, tc := range []struct {
+		name     string
+		signer   *Signer
+		expected string
+	}{
+		{name: "valid", signer: NewSigner("a", privateA)},
+		{name: "unsigned", expected: "message is not signed"},
+		{name: "unknown signer", signer: NewSigner("c", privateA), expected: "unknown signer 'c'"},
+		{name: "forged", signer: NewSigner("a", forged), expected: "invalid signature from signer 'a'"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			a, b := newDocs()
+			// encryption is used too in order to check that the signature survives it
+			err := SyncSharedDocs(ctx,
+				a, []StreamOption{WithStreamSigner(tc.signer), WithStreamEncryption(keyring), WithStreamTerminationCheck(HeadsEqualCheck), WithStreamLineReadPredicate(VerifySignaturesReadPredicate(keys))},
+				b, []StreamOption{WithStreamSigner(NewSigner("b", privateB)), WithStreamEncryption(keyring), WithStreamTerminationCheck(HeadsEqualCheck), WithStreamLineReadPredicate(VerifySignaturesReadPredicate(keys))},
+			)
+			if tc.expected == "" {
+				assertEqual(t, err, nil)
+				assertEqual(t, a.Doc().Heads(), b.Doc().Heads())
+			} else {
+				assertEqual(t, err != nil && strings.HasSuffix(err.Error(), ": "+tc.expected), true)
+				assertEqual(t, b.Doc().RootMap().Len(), 0)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package automergendjsonsync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/automerge/automerge-go"
+)
+
+// HeadsResponse is the json body returned by ServeHeads.
+type HeadsResponse struct {
+	Heads []string `json:"heads"`
+}
+
+// HeadsETag returns the strong ETag for the given heads. The ETag does not depend on the order of the heads, so a
+// client can compute it from its own heads and send it in an If-None-Match header to cheaply check whether the
+// server has the same heads.
+func HeadsETag(heads []automerge.ChangeHash) string {
+	sorted := slices.SortedFunc(slices.Values(heads), func(a, b automerge.ChangeHash) int {
+		return strings.Compare(a.String(), b.String())
+	})
+	h := sha256.New()
+	for _, head := range sorted {
+		_, _ = h.Write(head[:])
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)) + `"`
+}
+
+// readAtHeads calls f and returns its result along with the heads that the result corresponds to. Since the doc may
+// be changing concurrently, this retries until the heads are unchanged across the call, and if the doc is too busy it
+// falls back to calling f on a fork of the doc.
+func readAtHeads(doc *automerge.Doc, f func(doc *automerge.Doc) ([]byte, error)) ([]automerge.ChangeHash, []byte, error) {
+	for i := 0; i < 3; i++ {
+		heads := doc.Heads()
+		data, err := f(doc)
+		if err != nil || slices.Equal(heads, doc.Heads()) {
+			return heads, data, err
+		}
+	}
+	heads := doc.Heads()
+	fork, err := doc.Fork(heads...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fork doc: %w", err)
+	}
+	data, err := f(fork)
+	return heads, data, err
+}
+
+// notModified returns true if the request has an If-None-Match header that matches the ETag.
+func notModified(req *http.Request, etag string) bool {
+	for _, v := range req.Header.Values("If-None-Match") {
+		for _, candidate := range strings.Split(v, ",") {
+			if candidate = strings.TrimSpace(candidate); candidate == etag || candidate == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeAtHeads writes the response body along with the ETag of the heads, or a 304 if the client already has them.
+func writeAtHeads(rw http.ResponseWriter, req *http.Request, heads []automerge.ChangeHash, contentType string, body []byte) error {
+	etag := HeadsETag(heads)
+	rw.Header().Set("ETag", etag)
+	rw.Header().Set("Cache-Control", "no-cache")
+	if notModified(req, etag) {
+		rw.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.WriteHeader(http.StatusOK)
+	_, err := rw.Write(body)
+	return err
+}
+
+// ServeSnapshot responds with the saved binary form of the whole doc, as produced by automerge.Doc.Save. The response
+// has a strong ETag derived from the heads so clients can make a conditional request with If-None-Match.
+func (b *SharedDoc) ServeSnapshot(rw http.ResponseWriter, req *http.Request) error {
+	heads, data, err := readAtHeads(b.Doc(), func(doc *automerge.Doc) ([]byte, error) {
+		return doc.Save(), nil
+	})
+	if err != nil {
+		return err
+	}
+	return writeAtHeads(rw, req, heads, "application/octet-stream", data)
+}
+
+// ServeHeads responds with the current heads of the doc as a json HeadsResponse. This is a cheap way for a client to
+// check whether it is up-to-date before opening a sync stream. The response has the same ETag as ServeSnapshot.
+func (b *SharedDoc) ServeHeads(rw http.ResponseWriter, req *http.Request) error {
+	heads := b.Doc().Heads()
+	hr := HeadsResponse{Heads: make([]string, len(heads))}
+	for i, head := range heads {
+		hr.Heads[i] = head.String()
+	}
+	data, _ := json.Marshal(hr)
+	return writeAtHeads(rw, req, heads, "application/json", data)
+}
+
+// ServeChangesSince responds with the changes made to the doc since the heads given in the repeated "since" query
+// parameter, concatenated in the form produced by automerge.SaveChanges, which a client can apply with
+// automerge.Doc.LoadIncremental. Without any "since" parameters, all changes are returned. Unknown heads are rejected
+// with a 400 status code since the changes can't be computed.
+func (b *SharedDoc) ServeChangesSince(rw http.ResponseWriter, req *http.Request) error {
+	since := make([]automerge.ChangeHash, 0)
+	for _, v := range req.URL.Query()["since"] {
+		hash, err := automerge.NewChangeHash(v)
+		if err == nil {
+			_, err = b.Doc().Change(hash)
+		}
+		if err != nil {
+			Logger(req.Context()).InfoContext(req.Context(), "rejecting invalid since parameter", slog.String("since", v), slog.Any("err", err))
+			http.Error(rw, fmt.Sprintf("invalid since parameter: %s", v), http.StatusBadRequest)
+			return nil
+		}
+		since = append(since, hash)
+	}
+	heads, data, err := readAtHeads(b.Doc(), func(doc *automerge.Doc) ([]byte, error) {
+		changes, err := doc.Changes(since...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get changes: %w", err)
+		}
+		return automerge.SaveChanges(changes), nil
+	})
+	if err != nil {
+		return err
+	}
+	return writeAtHeads(rw, req, heads, "application/octet-stream", data)
+}
+
+// HttpFetchHeads fetches the heads of a remote doc from an endpoint served by ServeHeads. Only the http client and
+// request editor options are used. Comparing the result with the local heads through CompareHeads is a cheap way to
+// decide whether a sync is required.
+func HttpFetchHeads(ctx context.Context, url string, opts ...ClientOption) ([]automerge.ChangeHash, error) {
+	o := newClientOptions(opts...)
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup request: %w", err)
+	}
+	r.Header.Set("Accept", "application/json")
+	for _, editor := range o.reqEditors {
+		editor(r)
+	}
+	res, err := o.client.Do(r)
+	if err != nil {
+		return nil, fmt.Errorf("http request failed: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http request failed with status %d", res.StatusCode)
+	}
+	raw, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	hr := HeadsResponse{}
+	if err := json.Unmarshal(raw, &hr); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	heads := make([]automerge.ChangeHash, len(hr.Heads))
+	for i, v := range hr.Heads {
+		if heads[i], err = automerge.NewChangeHash(v); err != nil {
+			return nil, fmt.Errorf("invalid head %s: %w", v, err)
+		}
+	}
+	return heads, nil
+}
@@ -0,0 +1,102 @@
+package automergendjsonsync
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/automerge/automerge-go"
+)
+
+func newTestSnapshotDoc(t *testing.T) (*SharedDoc, automerge.ChangeHash) {
+	t.Helper()
+	sd := NewSharedDoc(automerge.New())
+	assertEqual(t, sd.Doc().RootMap().Set("a", "b"), nil)
+	first, _ := sd.Doc().Commit("first")
+	assertEqual(t, sd.Doc().RootMap().Set("c", "d"), nil)
+	_, _ = sd.Doc().Commit("second")
+	return sd, first
+}
+
+func TestHeadsETag(t *testing.T) {
+	t.Parallel()
+	assertEqual(t, HeadsETag([]automerge.ChangeHash{{1}, {2}}), HeadsETag([]automerge.ChangeHash{{2}, {1}}))
+	assertEqual(t, HeadsETag([]automerge.ChangeHash{{1}}) != HeadsETag([]automerge.ChangeHash{{2}}), true)
+}
+
+func TestServeSnapshot(t *testing.T) {
+	t.Parallel()
+	sd, _ := newTestSnapshotDoc(t)
+
+	rw := httptest.NewRecorder()
+	assertEqual(t, sd.ServeSnapshot(rw, httptest.NewRequest(http.MethodGet, "/", nil)), nil)
+	assertEqual(t, rw.Code, http.StatusOK)
+	assertEqual(t, rw.Header().Get("Content-Type"), "application/octet-stream")
+	assertEqual(t, rw.Header().Get("ETag"), HeadsETag(sd.Doc().Heads()))
+	loaded, err := automerge.Load(rw.Body.Bytes())
+	assertEqual(t, err, nil)
+	assertEqual(t, loaded.Heads(), sd.Doc().Heads())
+
+	rw = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("If-None-Match", `"other", `+HeadsETag(sd.Doc().Heads()))
+	assertEqual(t, sd.ServeSnapshot(rw, req), nil)
+	assertEqual(t, rw.Code, http.StatusNotModified)
+	assertEqual(t, rw.Body.Len(), 0)
+}
+
+func TestServeHeads(t *testing.T) {
+	t.Parallel()
+	sd, _ := newTestSnapshotDoc(t)
+	rw := httptest.NewRecorder()
+	assertEqual(t, sd.ServeHeads(rw, httptest.NewRequest(http.MethodGet, "/", nil)), nil)
+	assertEqual(t, rw.Code, http.StatusOK)
+	assertEqual(t, rw.Header().Get("Content-Type"), "application/json")
+	assertEqual(t, rw.Header().Get("ETag"), HeadsETag(sd.Doc().Heads()))
+	assertEqual(t, rw.Body.String(), `{"heads":["`+sd.Doc().Heads()[0].String()+`"]}`)
+}
+
+func TestServeChangesSince(t *testing.T) {
+	t.Parallel()
+	sd, first := newTestSnapshotDoc(t)
+
+	t.Run("since first", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		assertEqual(t, sd.ServeChangesSince(rw, httptest.NewRequest(http.MethodGet, "/?since="+first.String(), nil)), nil)
+		assertEqual(t, rw.Code, http.StatusOK)
+		// a doc that only has the first change can catch up by applying the response
+		fork, err := sd.Doc().Fork(first)
+		assertEqual(t, err, nil)
+		assertEqual(t, fork.LoadIncremental(rw.Body.Bytes()), nil)
+		assertEqual(t, fork.Heads(), sd.Doc().Heads())
+	})
+
+	t.Run("all", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		assertEqual(t, sd.ServeChangesSince(rw, httptest.NewRequest(http.MethodGet, "/", nil)), nil)
+		changes, err := automerge.LoadChanges(rw.Body.Bytes())
+		assertEqual(t, err, nil)
+		assertEqual(t, len(changes), 2)
+	})
+
+	t.Run("unknown since", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		assertEqual(t, sd.ServeChangesSince(rw, httptest.NewRequest(http.MethodGet, "/?since="+automerge.ChangeHash{1}.String(), nil)), nil)
+		assertEqual(t, rw.Code, http.StatusBadRequest)
+	})
+}
+
+func TestHttpFetchHeads(t *testing.T) {
+	t.Parallel()
+	sd, _ := newTestSnapshotDoc(t)
+	url := startTestServer(t, &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertEqual(t, r.Header.Get("Test-Header"), "Test-Value")
+		_ = sd.ServeHeads(w, r)
+	})})
+	heads, err := HttpFetchHeads(context.Background(), url, WithClientRequestEditor(func(r *http.Request) {
+		r.Header.Set("Test-Header", "Test-Value")
+	}))
+	assertEqual(t, err, nil)
+	assertEqual(t, heads, sd.Doc().Heads())
+}
@@ -0,0 +1,265 @@
+package automergendjsonsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/automerge/automerge-go"
+)
+
+type streamOptions struct {
+	state            *automerge.SyncState
+	readPredicate    ReadPredicate
+	linePredicates   []LineReadPredicate
+	terminationCheck TerminationCheck
+	readContentType  string
+	writeContentType string
+	recorder         Recorder
+	keyring          *Keyring
+	signer           *Signer
+	// rateLimiters delay or reject the messages that are read.
+	rateLimiters []*rateLimiter
+	// session counts the messages in each direction.
+	session *liveSession
+	// stripWrittenChanges and stripReadChanges drop the changes from the sync messages in each direction.
+	stripWrittenChanges bool
+	stripReadChanges    bool
+	// progress is called after each received and sent message.
+	progress func(progress SyncProgress)
+	// hooks are called after each received and sent sync message.
+	hooks *hookRunner
+	// sendAcks writes EventAck whenever the persisted heads of the doc change.
+	sendAcks bool
+	// noMessagesErr is returned if the stream ends before any sync message has been received.
+	noMessagesErr error
+	// writeUntilDone keeps writing messages after the reading has finished, until the context is done.
+	writeUntilDone bool
+}
+
+type StreamOption func(*streamOptions)
+
+func newStreamOptions(opts ...StreamOption) *streamOptions {
+	options := &streamOptions{
+		readPredicate:    NoReadPredicate,
+		terminationCheck: NoTerminationCheck,
+		readContentType:  ContentType,
+		writeContentType: ContentType,
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
+
+func WithStreamSyncState(state *automerge.SyncState) StreamOption {
+	return func(o *streamOptions) {
+		o.state = state
+	}
+}
+
+func WithStreamReadPredicate(f ReadPredicate) StreamOption {
+	return func(o *streamOptions) {
+		o.readPredicate = f
+	}
+}
+
+// WithStreamLineReadPredicate adds a LineReadPredicate which must include each message, along with the
+// ReadPredicate, for the message to be received. This can be used more than once.
+func WithStreamLineReadPredicate(f LineReadPredicate) StreamOption {
+	return func(o *streamOptions) {
+		o.linePredicates = append(o.linePredicates, f)
+	}
+}
+
+func WithStreamTerminationCheck(f TerminationCheck) StreamOption {
+	return func(o *streamOptions) {
+		o.terminationCheck = f
+	}
+}
+
+// WithStreamContentType sets the wire format used in both directions of the stream. This should be either
+// ContentType (the default) or ContentTypeBinary, and both ends of the stream must agree on it.
+func WithStreamContentType(contentType string) StreamOption {
+	return func(o *streamOptions) {
+		o.readContentType = contentType
+		o.writeContentType = contentType
+	}
+}
+
+// WithStreamRecorder passes every message read from and written to the stream to the recorder.
+func WithStreamRecorder(recorder Recorder) StreamOption {
+	return func(o *streamOptions) {
+		o.recorder = recorder
+	}
+}
+
+// WithStreamEncryption encrypts the data of every message written to the stream and requires every message read from
+// the stream to be encrypted, using the keys in the keyring.
+func WithStreamEncryption(keyring *Keyring) StreamOption {
+	return func(o *streamOptions) {
+		o.keyring = keyring
+	}
+}
+
+// WithStreamSigner signs the data of every message written to the stream. Use VerifySignaturesReadPredicate on the
+// other end to verify the signatures.
+func WithStreamSigner(signer *Signer) StreamOption {
+	return func(o *streamOptions) {
+		o.signer = signer
+	}
+}
+
+// isClosedStreamError returns true if the error indicates that the other end has closed the stream.
+func isClosedStreamError(err error) bool {
+	return errors.Is(err, io.ErrClosedPipe) || errors.Is(err, net.ErrClosed)
+}
+
+// SyncOverStream runs the sync protocol over any pair of streams, such as stdin and stdout, a unix socket, or a serial
+// link. Messages are read from r while messages are generated and written to w. Once the reading has finished, either
+// at the end of the stream or when the termination check is met, the writing stops and w is closed if it is an
+// io.Closer, which lets the other end know that there are no more messages. When the context is done, r is closed if
+// it is an io.Closer in order to unblock the reading, and the context error is returned. Both ServeChanges and
+// HttpPushPullChanges are built on this, so every transport has the same behaviour.
+func (b *SharedDoc) SyncOverStream(ctx context.Context, r io.Reader, w io.Writer, opts ...StreamOption) error {
+	o := newStreamOptions(opts...)
+	readContentType, ok := suitableContentType(o.readContentType)
+	if !ok {
+		return fmt.Errorf("unsupported content type %s", o.readContentType)
+	}
+	writeContentType, ok := suitableContentType(o.writeContentType)
+	if !ok {
+		return fmt.Errorf("unsupported content type %s", o.writeContentType)
+	}
+	if c, ok := r.(io.Closer); ok {
+		stop := context.AfterFunc(ctx, func() {
+			_ = c.Close()
+		})
+		defer stop()
+	}
+	return b.syncMessages(ctx, newMessageReader(readContentType, r), newMessageWriter(writeContentType, w), o)
+}
+
+// syncMessages is the core of SyncOverStream which works on messages rather than streams. This allows the http client
+// to start writing messages before it knows the format of the response.
+func (b *SharedDoc) syncMessages(ctx context.Context, reader messageReader, writer messageWriter, o *streamOptions) error {
+	if o.state == nil {
+		o.state = automerge.NewSyncState(b.Doc())
+	}
+	progress := newProgressTracker(o.progress)
+
+	// The reader is wrapped from the wire outwards, so each wrapper sees the messages as the one before it returns them.
+	// The session counts, and the rate limits apply to, the bytes on the wire before any work is done to decrypt them.
+	reader = sessionTrackReader(o.session, reader)
+	reader = rateLimitReader(ctx, o.rateLimiters, reader)
+	reader = encryptReader(o.keyring, reader)
+	// The recorder sees the decrypted messages so that recordings can be replayed without the keys.
+	reader = recordReader(o.recorder, reader)
+	reader = progressTrackReader(progress, reader)
+	reader = b.ackTrackReader(o.session, reader)
+
+	// The writer is wrapped from the wire outwards too, so messages pass through the wrappers in the opposite order.
+	// The session counts the bytes on the wire, after encryption.
+	writer = sessionTrackWriter(o.session, writer)
+	writer = encryptWriter(o.keyring, writer)
+	// The recorder sees the decrypted and signed messages, so that replays can also check the signatures.
+	writer = recordWriter(o.recorder, writer)
+	// Signatures cover the decrypted data so that they can be checked by the read predicates of the peer.
+	writer = signWriter(o.signer, writer)
+	writer = progressTrackWriter(progress, writer)
+	writer = o.hooks.writer(ctx, writer)
+	// Changes are stripped before anything else sees the message, so that the progress and hooks count what is sent.
+	writer = stripWriter(o.stripWrittenChanges, writer)
+
+	sub, fin := b.SubscribeToReceivedChanges()
+	defer fin()
+
+	parentCtx := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Messages are read in the background while they are written in the foreground. Starting the writer first means
+	// our first message doesn't depend on how quickly the other end's first message arrives.
+	readErrs := make(chan error, 1)
+	go func() {
+		readPredicate := AllLineReadPredicates(append([]LineReadPredicate{o.readPredicate.Line()}, o.linePredicates...)...)
+		received, err := b.consumeMessagesFromReader(ctx, o.state, reader, readPredicate, b.recordRemoteHeads(o.session, o.hooks.terminationCheck(ctx, progress.terminationCheck(o.terminationCheck))), o.stripReadChanges)
+		if err == nil && received == 0 && o.noMessagesErr != nil {
+			err = o.noMessagesErr
+		}
+		if err != nil || !o.writeUntilDone {
+			cancel()
+		}
+		readErrs <- err
+	}()
+
+	// Draining the session stops the writer early, after which the outstanding messages are flushed with a goodbye.
+	writeCtx, stopWriting := context.WithCancel(ctx)
+	defer stopWriting()
+	var drain <-chan struct{}
+	if o.session != nil {
+		drain = o.session.drain
+	}
+	go func() {
+		select {
+		case <-drain:
+			stopWriting()
+		case <-writeCtx.Done():
+		}
+	}()
+
+	var pendingEvents func() []*NdJson
+	if o.sendAcks {
+		pendingEvents = b.pendingAcks()
+	}
+	writeErr := generateMessagesToWriter(writeCtx, o.state, sub, writer, false, pendingEvents)
+	if errors.Is(writeErr, context.Canceled) {
+		writeErr = nil
+	}
+	if writeErr == nil && ctx.Err() == nil && writeCtx.Err() != nil {
+		writeErr = writeGoodbye(o.state, writer)
+	}
+	if err := closeWriter(writer); writeErr == nil {
+		writeErr = err
+	}
+	readErr := <-readErrs
+
+	if parentCtx.Err() != nil {
+		return parentCtx.Err()
+	} else if readErr != nil {
+		return readErr
+	} else if writeErr != nil && !isClosedStreamError(writeErr) {
+		return writeErr
+	}
+	return nil
+}
+
+// SyncSharedDocs synchronises two docs in the same process over a pair of in-memory pipes, using the same protocol
+// as the http client and server but without the network stack. Each doc has its own options, which is where the
+// read predicates and termination checks for each side are set. This returns when both sides have finished; since a
+// side that finishes closes its end of the pipes, the other side finishes as soon as it has read the remaining
+// messages. With the default NoTerminationCheck this runs until the context is done, and returns the context error.
+func SyncSharedDocs(ctx context.Context, a *SharedDoc, aOpts []StreamOption, b *SharedDoc, bOpts []StreamOption) error {
+	aToB, aWriter := io.Pipe()
+	bToA, bWriter := io.Pipe()
+
+	errs := make([]error, 2)
+	wg := new(sync.WaitGroup)
+	run := func(i int, doc *SharedDoc, opts []StreamOption, r *io.PipeReader, w *io.PipeWriter) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = doc.SyncOverStream(ctx, r, w, opts...)
+			// Unblock the other side if it is still writing to us.
+			_ = w.Close()
+			_ = r.Close()
+		}()
+	}
+	run(0, a, aOpts, bToA, aWriter)
+	run(1, b, bOpts, aToB, bWriter)
+	wg.Wait()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,64 @@
+package automergendjsonsync
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/automerge/automerge-go"
+)
+
+func TestSyncSharedDocs(t *testing.T) {
+	t.Parallel()
+	for _, contentType := range []string{ContentType, ContentTypeBinary} {
+		t.Run(contentType, func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			a, b := NewSharedDoc(automerge.New()), NewSharedDoc(automerge.New())
+			assertEqual(t, a.Doc().RootMap().Set("a", int64(1)), nil)
+			_, _ = a.Doc().Commit("change")
+			assertEqual(t, b.Doc().RootMap().Set("b", int64(2)), nil)
+			_, _ = b.Doc().Commit("change")
+
+			assertEqual(t, SyncSharedDocs(ctx,
+				a, []StreamOption{WithStreamContentType(contentType), WithStreamTerminationCheck(HeadsEqualCheck)},
+				b, []StreamOption{WithStreamContentType(contentType), WithStreamTerminationCheck(HeadsEqualCheck)},
+			), nil)
+			assertEqual(t, a.Doc().Heads(), b.Doc().Heads())
+			assertEqual(t, a.Doc().RootMap().Len(), 2)
+		})
+	}
+}
+
+func TestSyncSharedDocs_read_predicate(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	a, b := NewSharedDoc(automerge.New()), NewSharedDoc(automerge.New())
+	assertEqual(t, a.Doc().RootMap().Set("a", int64(1)), nil)
+	_, _ = a.Doc().Commit("change")
+
+	err := SyncSharedDocs(ctx, a, nil, b, []StreamOption{WithStreamReadPredicate(func(doc *automerge.Doc, m *automerge.SyncMessage) (bool, error) {
+		if len(m.Changes()) > 0 {
+			return false, errors.New("no changes allowed")
+		}
+		return true, nil
+	})})
+	// the message number depends on how the initial messages interleave
+	assertEqual(t, err != nil && strings.HasSuffix(err.Error(), ": no changes allowed"), true)
+	assertEqual(t, b.Doc().RootMap().Len(), 0)
+}
+
+func TestSyncSharedDocs_context_done(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	a, b := NewSharedDoc(automerge.New()), NewSharedDoc(automerge.New())
+	err := SyncSharedDocs(ctx, a, nil, b, nil)
+	assertEqual(t, errors.Is(err, context.DeadlineExceeded), true)
+}
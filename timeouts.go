@@ -0,0 +1,102 @@
+package automergendjsonsync
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// ErrSessionTimeout is the cause of a session that was disconnected by its idle timeout, or that didn't end within
+// lifetimeGracePeriod of reaching its maximum lifetime. It wraps ErrSessionDisconnected.
+var ErrSessionTimeout = fmt.Errorf("%w: timed out", ErrSessionDisconnected)
+
+// lifetimeGracePeriod is how long a session that has reached its maximum lifetime has to end after saying goodbye.
+const lifetimeGracePeriod = 10 * time.Second
+
+type sessionTimeouts struct {
+	// idle is how long the session may go without a message being read or written.
+	idle time.Duration
+	// lifetime is the maximum duration of the session, which is reduced by a random amount up to jitter.
+	lifetime time.Duration
+	jitter   time.Duration
+}
+
+// WithServerIdleTimeout disconnects a session when no message has been read or written for the given duration, so that
+// connections to peers that have gone away are cleaned up.
+func WithServerIdleTimeout(d time.Duration) ServerOption {
+	return func(o *serverOptions) {
+		o.timeouts.idle = d
+	}
+}
+
+// WithServerMaxLifetime drains a session when it reaches the given age, less a random amount up to jitter, so that
+// long-lived clients reconnect and spread across servers over time. The jitter prevents clients that connected at the
+// same time from all reconnecting at once.
+func WithServerMaxLifetime(d time.Duration, jitter time.Duration) ServerOption {
+	return func(o *serverOptions) {
+		o.timeouts.lifetime = d
+		o.timeouts.jitter = jitter
+	}
+}
+
+// WithClientIdleTimeout disconnects the session when no message has been read or written for the given duration, in
+// which case HttpPushPullChanges returns ErrSessionTimeout.
+func WithClientIdleTimeout(d time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.timeouts.idle = d
+	}
+}
+
+// WithClientMaxLifetime drains the session when it reaches the given age, less a random amount up to jitter, after
+// which HttpPushPullChanges returns once the server has ended the response.
+func WithClientMaxLifetime(d time.Duration, jitter time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.timeouts.lifetime = d
+		o.timeouts.jitter = jitter
+	}
+}
+
+// watch enforces the timeouts on the session until the context is done. When the lifetime is reached the session is
+// drained, so that it says goodbye to the peer, and then disconnected if it hasn't ended after the grace period.
+func (s *liveSession) watch(ctx context.Context, t sessionTimeouts) {
+	if t.idle <= 0 && t.lifetime <= 0 {
+		return
+	}
+	var expires, graceUntil time.Time
+	if t.lifetime > 0 {
+		lifetime := t.lifetime
+		if t.jitter > 0 {
+			lifetime -= time.Duration(rand.Int64N(int64(t.jitter)))
+		}
+		expires = s.snapshot().StartedAt.Add(lifetime)
+	}
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return
+		}
+		now := time.Now()
+		var idleUntil time.Time
+		if t.idle > 0 {
+			idleUntil = s.snapshot().LastActivity.Add(t.idle)
+		}
+		if (!idleUntil.IsZero() && !now.Before(idleUntil)) || (!graceUntil.IsZero() && !now.Before(graceUntil)) {
+			s.cancel(ErrSessionTimeout)
+			return
+		} else if !expires.IsZero() && !now.Before(expires) {
+			s.startDrain()
+			expires, graceUntil = time.Time{}, now.Add(lifetimeGracePeriod)
+		}
+		next := time.Time{}
+		for _, v := range []time.Time{idleUntil, expires, graceUntil} {
+			if !v.IsZero() && (next.IsZero() || v.Before(next)) {
+				next = v
+			}
+		}
+		timer.Reset(next.Sub(now))
+	}
+}
@@ -0,0 +1,91 @@
+package automergendjsonsync
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/automerge/automerge-go"
+)
+
+func TestSessionTimeouts(t *testing.T) {
+	t.Parallel()
+
+	// serve starts a server with the options and syncs a new client doc with it, returning how long the client ran
+	// for along with the errors from each side.
+	serve := func(t *testing.T, serverOpts []ServerOption, clientOpts []ClientOption) (time.Duration, error, error) {
+		serverDoc := NewSharedDoc(automerge.New())
+		assertEqual(t, serverDoc.Doc().RootMap().Set("a", "b"), nil)
+		_, _ = serverDoc.Doc().Commit("change")
+		serveErrs := make(chan error, 1)
+		url := startTestServer(t, &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			serveErrs <- serverDoc.ServeChanges(w, r, serverOpts...)
+		})})
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+		start := time.Now()
+		clientErr := NewSharedDoc(automerge.New()).HttpPushPullChanges(ctx, url, clientOpts...)
+		return time.Since(start), clientErr, <-serveErrs
+	}
+
+	t.Run("server idle", func(t *testing.T) {
+		t.Parallel()
+		elapsed, clientErr, serveErr := serve(t, []ServerOption{WithServerIdleTimeout(100 * time.Millisecond)}, nil)
+		assertEqual(t, clientErr, nil)
+		assertEqual(t, serveErr, nil)
+		assertEqual(t, elapsed >= 100*time.Millisecond && elapsed < 5*time.Second, true)
+	})
+
+	t.Run("client idle", func(t *testing.T) {
+		t.Parallel()
+		elapsed, clientErr, serveErr := serve(t, nil, []ClientOption{WithClientIdleTimeout(100 * time.Millisecond)})
+		assertEqual(t, clientErr, ErrSessionTimeout)
+		assertEqual(t, errors.Is(clientErr, ErrSessionDisconnected), true)
+		assertEqual(t, serveErr, nil)
+		assertEqual(t, elapsed >= 100*time.Millisecond && elapsed < 5*time.Second, true)
+	})
+
+	t.Run("server lifetime", func(t *testing.T) {
+		t.Parallel()
+		elapsed, clientErr, serveErr := serve(t, []ServerOption{WithServerMaxLifetime(300*time.Millisecond, 100*time.Millisecond)}, nil)
+		assertEqual(t, errors.Is(clientErr, ErrPeerGoodbye), true)
+		assertEqual(t, serveErr, nil)
+		assertEqual(t, elapsed >= 200*time.Millisecond && elapsed < 5*time.Second, true)
+	})
+
+	t.Run("client lifetime", func(t *testing.T) {
+		t.Parallel()
+		elapsed, clientErr, serveErr := serve(t, nil, []ClientOption{WithClientMaxLifetime(300*time.Millisecond, 0)})
+		assertEqual(t, clientErr, nil)
+		assertEqual(t, serveErr, nil)
+		assertEqual(t, elapsed >= 300*time.Millisecond && elapsed < 5*time.Second, true)
+	})
+
+	t.Run("activity", func(t *testing.T) {
+		t.Parallel()
+		// messages flowing keep the session from going idle
+		serverDoc := NewSharedDoc(automerge.New())
+		url := startTestServer(t, &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_ = serverDoc.ServeChanges(w, r)
+		})})
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+		clientDoc := NewSharedDoc(automerge.New())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 25; i++ {
+				time.Sleep(20 * time.Millisecond)
+				assertEqual(t, clientDoc.Doc().RootMap().Set("i", int64(i)), nil)
+				_, _ = clientDoc.Doc().Commit("change")
+				clientDoc.NotifyReceivedChanges()
+			}
+			cancel()
+		}()
+		err := clientDoc.HttpPushPullChanges(ctx, url, WithClientIdleTimeout(200*time.Millisecond))
+		<-done
+		assertEqual(t, errors.Is(err, context.Canceled), true)
+	})
+}
@@ -2,9 +2,35 @@ package automergendjsonsync
 
 const ContentType = "application/x-ndjson"
 const ContentTypeWithCharset = ContentType + "; charset=utf-8"
+
+// ContentTypeBinary is an alternative to ContentType which avoids the cost of base64 inside json. Each message is a
+// uvarint length prefix followed by a frame of that length. The frame starts with an event-type byte followed by a
+// series of fields, each of which is a field tag byte and a uvarint length prefixed value. Common events have their
+// own event-type byte, any other event uses byte 0 and carries its name in a field. New event bytes are only assigned
+// for events that are frequent enough for the name to matter, and readers skip frames with an event byte they don't
+// know, so adding events never breaks existing binary peers.
+const ContentTypeBinary = "application/vnd.automerge-sync"
+
 const EventSync = "sync"
 
+// EventGoodbye is sent without data by a peer that is draining, after it has flushed its outstanding messages, to
+// tell the other end to reconnect, possibly to another server. See SharedDoc.Drain.
+const EventGoodbye = "goodbye"
+
+// EventAck is sent by ServeChanges with the heads that the storage of the doc has persisted, see
+// SharedDoc.MarkPersisted. The data is the concatenated 32 byte change hashes.
+const EventAck = "ack"
+
 type NdJson struct {
 	Event string `json:"event"`
 	Data  []byte `json:"data,omitempty"`
+	// KeyId is the id of the key that Data is encrypted with, see NewKeyring. It is empty if Data is not encrypted.
+	KeyId string `json:"key_id,omitempty"`
+	// Signature is the ed25519 signature of the event and unencrypted Data, made by the signer named by SignerId. See
+	// NewSigner.
+	Signature []byte `json:"sig,omitempty"`
+	SignerId  string `json:"signer,omitempty"`
+
+	// sent is the parsed form of a sync message that we generated, see newSyncMessageLine.
+	sent *sentSyncMessage
 }
@@ -1,6 +1,9 @@
 package automergendjsonsync
 
 import (
+	"errors"
+	"net"
+	"net/http"
 	"reflect"
 	"testing"
 )
@@ -25,3 +28,24 @@ func assertErrorEqual(t *testing.T, actual error, expected string) bool {
 	}
 	return true
 }
+
+// startTestServer serves the given server on a random local port until the test completes and returns its base url.
+// Any error from serving is reported to the test during cleanup.
+func startTestServer(t *testing.T, server *http.Server) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+	t.Cleanup(func() {
+		_ = server.Close()
+		if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+			t.Errorf("server failed: %v", err)
+		}
+	})
+	return "http://" + listener.Addr().String()
+}
@@ -0,0 +1,153 @@
+package automergendjsonsync
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/automerge/automerge-go"
+)
+
+// recordRemoteHeads wraps the termination check so that the heads advertised by each received message are recorded
+// on the session, for WaitForRemoteHeads. The heads that the remote last synced with us are included too, since the
+// remote's own heads may not be known locally, such as with WithClientPushOnly.
+func (b *SharedDoc) recordRemoteHeads(s *liveSession, check TerminationCheck) TerminationCheck {
+	if s == nil {
+		return check
+	}
+	return func(doc *automerge.Doc, m *automerge.SyncMessage) bool {
+		remoteHeads := m.Heads()
+		if _, have, _, err := parseSyncMessageNeedHave(m.Bytes()); err == nil {
+			for _, h := range have {
+				remoteHeads = append(remoteHeads, h.lastSync...)
+			}
+		}
+		s.mutex.Lock()
+		s.remoteHeads = remoteHeads
+		s.mutex.Unlock()
+
+		b.mutex.Lock()
+		b.notifyRemoteHeadsChanged()
+		b.mutex.Unlock()
+		return check(doc, m)
+	}
+}
+
+// notifyRemoteHeadsChanged wakes up the waiters of waitForRemoteHeads. The doc lock must be held.
+func (b *SharedDoc) notifyRemoteHeadsChanged() {
+	if b.remoteHeadsChanged != nil {
+		close(b.remoteHeadsChanged)
+		b.remoteHeadsChanged = nil
+	}
+}
+
+// WaitForRemoteHeads blocks until the peer of an active session that uses the given sync state has advertised all
+// the given heads, or changes that build on them. This gives a write concern on top of HttpPushPullChanges or
+// ServeChanges: after a local change, wait for the doc's heads to be sure that the peer has received it. Only the
+// messages of active sessions count, so when the session has ended this waits for the next one with the same state,
+// such as when reconnecting with the same WithClientSyncState, until the context is done.
+func (b *SharedDoc) WaitForRemoteHeads(ctx context.Context, state *automerge.SyncState, heads []automerge.ChangeHash) error {
+	return b.waitForRemoteHeads(ctx, heads, advertisedHeads, func(sessions map[string]*liveSession) ([]*liveSession, error) {
+		return sessionsWithState(sessions, state), nil
+	})
+}
+
+// WaitForSessionHeads is like WaitForRemoteHeads for the session with the given id, see Sessions. It returns an error
+// if the session ends first.
+func (b *SharedDoc) WaitForSessionHeads(ctx context.Context, id string, heads []automerge.ChangeHash) error {
+	return b.waitForRemoteHeads(ctx, heads, advertisedHeads, func(sessions map[string]*liveSession) ([]*liveSession, error) {
+		s, ok := sessions[id]
+		if !ok {
+			return nil, fmt.Errorf("no session with id '%s'", id)
+		}
+		return []*liveSession{s}, nil
+	})
+}
+
+func advertisedHeads(s *liveSession) []automerge.ChangeHash {
+	return s.remoteHeads
+}
+
+func sessionsWithState(sessions map[string]*liveSession, state *automerge.SyncState) []*liveSession {
+	out := make([]*liveSession, 0, 1)
+	for _, s := range sessions {
+		if s.state == state {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// waitForRemoteHeads waits until the remote heads, as returned by the getter under the session lock, of any of the
+// sessions picked by the function, under the doc lock, have the heads.
+func (b *SharedDoc) waitForRemoteHeads(ctx context.Context, heads []automerge.ChangeHash, get func(s *liveSession) []automerge.ChangeHash, pick func(sessions map[string]*liveSession) ([]*liveSession, error)) error {
+	for {
+		b.mutex.Lock()
+		if b.remoteHeadsChanged == nil {
+			b.remoteHeadsChanged = make(chan struct{})
+		}
+		changed := b.remoteHeadsChanged
+		sessions, err := pick(b.sessions)
+		b.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+
+		for _, s := range sessions {
+			s.mutex.Lock()
+			remoteHeads := get(s)
+			s.mutex.Unlock()
+			if historyHasHeads(b.doc, remoteHeads, heads) {
+				return nil
+			}
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// historyHasHeads returns whether each of the heads is either one of the remote heads or an ancestor of those that are
+// known to the doc.
+func historyHasHeads(doc *automerge.Doc, remoteHeads []automerge.ChangeHash, heads []automerge.ChangeHash) bool {
+	remote := make(map[automerge.ChangeHash]bool, len(remoteHeads))
+	known := make([]automerge.ChangeHash, 0, len(remoteHeads))
+	for _, h := range remoteHeads {
+		if remote[h] {
+			continue
+		}
+		remote[h] = true
+		if _, err := doc.Change(h); err == nil {
+			known = append(known, h)
+		}
+	}
+	missing := make([]automerge.ChangeHash, 0, len(heads))
+	for _, h := range heads {
+		if !remote[h] {
+			missing = append(missing, h)
+		}
+	}
+	if len(missing) == 0 {
+		return true
+	} else if len(known) == 0 {
+		return false
+	}
+
+	// The changes since the known remote heads are those that aren't in their history.
+	since, err := doc.Changes(known...)
+	if err != nil {
+		return false
+	}
+	notInHistory := make(map[automerge.ChangeHash]bool, len(since))
+	for _, c := range since {
+		notInHistory[c.Hash()] = true
+	}
+	for _, h := range missing {
+		if _, err := doc.Change(h); err != nil || notInHistory[h] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,87 @@
+package automergendjsonsync
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/automerge/automerge-go"
+)
+
+func TestWaitForRemoteHeads(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	serverDoc := NewSharedDoc(automerge.New())
+	serveErrs := make(chan error, 1)
+	url := startTestServer(t, &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveErrs <- serverDoc.ServeChanges(w, r)
+	})})
+
+	clientDoc := NewSharedDoc(automerge.New())
+	state := automerge.NewSyncState(clientDoc.Doc())
+	clientErrs := make(chan error, 1)
+	go func() {
+		clientErrs <- clientDoc.HttpPushPullChanges(ctx, url, WithClientSyncState(state))
+	}()
+	session := waitForSession(t, clientDoc)
+
+	for i := 0; i < 3; i++ {
+		assertEqual(t, clientDoc.Doc().RootMap().Set("a", int64(i)), nil)
+		_, _ = clientDoc.Doc().Commit("change")
+		clientDoc.NotifyReceivedChanges()
+		heads := clientDoc.Doc().Heads()
+		assertEqual(t, clientDoc.WaitForRemoteHeads(ctx, state, heads), nil)
+		missingInServer, _ := CompareHeads(serverDoc.Doc().Heads(), heads)
+		assertEqual(t, missingInServer, 0)
+		assertEqual(t, clientDoc.WaitForSessionHeads(ctx, session.Id, heads), nil)
+	}
+
+	t.Run("other state", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(ctx, time.Millisecond*50)
+		defer cancel()
+		err := clientDoc.WaitForRemoteHeads(ctx, automerge.NewSyncState(clientDoc.Doc()), clientDoc.Doc().Heads())
+		assertEqual(t, errors.Is(err, context.DeadlineExceeded), true)
+	})
+
+	t.Run("session ends", func(t *testing.T) {
+		fork, err := clientDoc.Doc().Fork()
+		assertEqual(t, err, nil)
+		assertEqual(t, fork.RootMap().Set("b", "c"), nil)
+		unsynced, _ := fork.Commit("change")
+
+		waitErrs := make(chan error, 1)
+		go func() {
+			waitErrs <- clientDoc.WaitForSessionHeads(ctx, session.Id, []automerge.ChangeHash{unsynced})
+		}()
+		assertEqual(t, clientDoc.DisconnectSession(session.Id), true)
+		assertErrorEqual(t, <-waitErrs, "no session with id '"+session.Id+"'")
+		assertEqual(t, errors.Is(<-clientErrs, ErrSessionDisconnected), true)
+		assertEqual(t, <-serveErrs, nil)
+	})
+}
+
+func TestHistoryHasHeads(t *testing.T) {
+	t.Parallel()
+	doc := automerge.New()
+	assertEqual(t, doc.RootMap().Set("a", "b"), nil)
+	first, _ := doc.Commit("change")
+	assertEqual(t, doc.RootMap().Set("a", "c"), nil)
+	second, _ := doc.Commit("change")
+	fork, err := doc.Fork()
+	assertEqual(t, err, nil)
+	assertEqual(t, fork.RootMap().Set("a", "d"), nil)
+	unknown, _ := fork.Commit("change")
+
+	assertEqual(t, historyHasHeads(doc, nil, nil), true)
+	assertEqual(t, historyHasHeads(doc, nil, []automerge.ChangeHash{first}), false)
+	assertEqual(t, historyHasHeads(doc, []automerge.ChangeHash{first}, []automerge.ChangeHash{first}), true)
+	assertEqual(t, historyHasHeads(doc, []automerge.ChangeHash{second}, []automerge.ChangeHash{first, second}), true)
+	assertEqual(t, historyHasHeads(doc, []automerge.ChangeHash{first}, []automerge.ChangeHash{second}), false)
+	// remote heads that aren't known locally can only match exactly
+	assertEqual(t, historyHasHeads(doc, []automerge.ChangeHash{unknown}, []automerge.ChangeHash{first}), false)
+	assertEqual(t, historyHasHeads(doc, []automerge.ChangeHash{unknown}, []automerge.ChangeHash{unknown}), true)
+}
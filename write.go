@@ -2,11 +2,8 @@ package automergendjsonsync
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"io"
 	"log/slog"
-	"net/http"
 	"slices"
 
 	"github.com/automerge/automerge-go"
@@ -33,7 +30,35 @@ func (b *SharedDoc) SubscribeToReceivedChanges() (chan bool, func()) {
 	}
 }
 
-func generateMessagesToWriter(ctx context.Context, state *automerge.SyncState, hintChannel <-chan bool, writer io.Writer, immediate bool) error {
+// sentSyncMessage is the parsed form of a sync message that we generated. It travels along with the message through
+// the writers so that those which inspect outgoing messages don't need to parse the data again.
+type sentSyncMessage struct {
+	message *automerge.SyncMessage
+	raw     []byte
+	// changes is the number of changes in the message, which is zero if they have been stripped.
+	changes int
+	need    int
+}
+
+// newSyncMessageLine returns the message to write for a generated sync message.
+func newSyncMessageLine(m *automerge.SyncMessage) *NdJson {
+	raw := m.Bytes()
+	return &NdJson{Event: EventSync, Data: raw, sent: &sentSyncMessage{message: m, raw: raw, changes: len(m.Changes()), need: -1}}
+}
+
+// needCount returns the length of the need list of the message. Automerge doesn't expose the need list, so it is
+// parsed from the raw message when first asked for.
+func (s *sentSyncMessage) needCount() int {
+	if s.need < 0 {
+		need, _, _, _ := parseSyncMessageNeedHave(s.raw)
+		s.need = len(need)
+	}
+	return s.need
+}
+
+// generateMessagesToWriter writes the sync messages generated by the state, waking up on each hint to generate more
+// until the context is done. After each round of sync messages, any events returned by pendingEvents are written too.
+func generateMessagesToWriter(ctx context.Context, state *automerge.SyncState, hintChannel <-chan bool, writer messageWriter, immediate bool, pendingEvents func() []*NdJson) error {
 	log := Logger(ctx)
 	sent, sentBytes, sentChanges := 0, 0, 0
 	defer func() {
@@ -42,21 +67,24 @@ func generateMessagesToWriter(ctx context.Context, state *automerge.SyncState, h
 
 	for {
 		for {
-			if m, ok := state.GenerateMessage(); !ok {
+			m, ok := state.GenerateMessage()
+			if !ok {
 				break
-			} else {
-				r, _ := json.Marshal(&NdJson{Event: EventSync, Data: m.Bytes()})
-				r = append(r, '\n')
-				if n, err := writer.Write(r); err != nil {
-					return fmt.Errorf("failed to marshal: %w", err)
-				} else {
-					sent += 1
-					sentBytes += n
-					sentChanges += len(m.Changes())
-					log.DebugContext(ctx, "wrote message", slog.Int("changes", len(m.Changes())), slog.Int("bytes", n), slog.Any("heads", LoggableChangeHashes(m.Heads())))
-				}
-				if f, ok := writer.(http.Flusher); ok {
-					f.Flush()
+			}
+			line := newSyncMessageLine(m)
+			n, err := writer.WriteMessage(line)
+			if err != nil {
+				return fmt.Errorf("failed to write message: %w", err)
+			}
+			sent += 1
+			sentBytes += n
+			sentChanges += line.sent.changes
+			log.DebugContext(ctx, "wrote message", slog.Int("changes", line.sent.changes), slog.Int("bytes", n), slog.Any("heads", LoggableChangeHashes(m.Heads())))
+		}
+		if pendingEvents != nil {
+			for _, e := range pendingEvents() {
+				if _, err := writer.WriteMessage(e); err != nil {
+					return fmt.Errorf("failed to write %s: %w", e.Event, err)
 				}
 			}
 		}
@@ -70,10 +98,8 @@ func generateMessagesToWriter(ctx context.Context, state *automerge.SyncState, h
 			return ctx.Err()
 		}
 	}
-	if v, ok := writer.(io.Closer); ok {
-		if err := v.Close(); err != nil {
-			return fmt.Errorf("failed to close writer: %w", err)
-		}
+	if err := closeWriter(writer); err != nil {
+		return fmt.Errorf("failed to close writer: %w", err)
 	}
 	return nil
 }